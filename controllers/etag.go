@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"captureorderfd/models"
+	"strconv"
+	"strings"
+)
+
+// orderETag is the strong ETag of an order, derived from its version
+func orderETag(order models.Order) string {
+	return `"` + strconv.FormatInt(order.Version, 10) + `"`
+}
+
+// ifMatchError reports an If-Match header that isn't * or a single ETag of an order
+type ifMatchError struct {
+	value string
+}
+
+func (e *ifMatchError) Error() string {
+	return "If-Match must be * or a single ETag returned for the order, not " + strconv.Quote(e.value)
+}
+
+// parseIfMatch returns the order version required by an If-Match header,
+// models.AnyVersion when the header is missing or *.
+func parseIfMatch(header string) (int64, error) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return models.AnyVersion, nil
+	}
+
+	// Weak ETags never match for If-Match, and orders only have strong ones
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' {
+		return 0, &ifMatchError{header}
+	}
+	version, err := strconv.ParseInt(header[1:len(header)-1], 10, 64)
+	if err != nil || version < 0 {
+		return 0, &ifMatchError{header}
+	}
+	return version, nil
+}
+
+// serveOrder writes the order as the response along with its ETag
+func (this *OrderController) serveOrder(order models.Order) {
+	this.Ctx.Output.Header("ETag", orderETag(order))
+	this.Data["json"] = order
+	this.ServeJSON()
+}
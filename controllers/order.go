@@ -23,6 +23,13 @@ var teamName = os.Getenv("TEAMNAME")
 // Operations about object
 type OrderController struct {
 	beego.Controller
+
+	// Store persists the orders, Idempotency remembers Idempotency-Keys.
+	// Set both on the controller registered with the router.
+	Store       models.OrderStore
+	Idempotency models.IdempotencyStore
+
+	correlationID string
 }
 
 func init() {
@@ -47,13 +54,27 @@ func init() {
 // @Title Capture Order
 // @Description Capture order POST
 // @Param	body	body 	models.Order true		"body for order content"
+// @Param	Idempotency-Key	header	string	false	"retries with the same key return the original response"
 // @Success 200 {string} models.Order.ID
-// @Failure 403 body is empty
+// @Failure 400 order is not valid
+// @Failure 409 a request with the same Idempotency-Key is in progress
+// @Failure 422 the Idempotency-Key was used with a different body
 // @router / [post]
 func (this *OrderController) Post() {
 
-	var ob models.Order
-	json.Unmarshal(this.Ctx.Input.RequestBody, &ob)
+	// Reject invalid orders before they reach MongoDB or the queue
+	ob, err := models.DecodeOrder(this.Ctx.Input.RequestBody)
+	if err != nil {
+		this.serveProblem(this.validationProblem(err))
+		return
+	}
+
+	// Retries sent with the same Idempotency-Key get the original response instead of a new order
+	idempotencyKey := this.Ctx.Input.Header("Idempotency-Key")
+	reservation, replayed := this.replayIdempotentRequest(idempotencyKey, models.HashRequest(this.Ctx.Input.RequestBody))
+	if replayed {
+		return
+	}
 
 	// Inject telemetry clients
 	//models.CustomTelemetryClient = customTelemetryClient;
@@ -62,34 +83,193 @@ func (this *OrderController) Post() {
 	// Track the request
 	requestStartTime := time.Now()
 
-	// Add the order to MongoDB
-	orderID, err := models.AddOrderToMongoDB(ob)
+	// Add the order to MongoDB. Its AMQP message is stored with it and sent by the outbox relay.
+	ob.CorrelationID = this.correlationID
+	ob, err = this.Store.Create(ob)
+	orderID := ob.ID.Hex()
 	var orderAddedToMongoDb = false
-	var orderAddedToAMQP = false
 
 	if err == nil {
 		orderAddedToMongoDb = true
 
-		// Add the order to AMQP
-		orderAddedToAMQP = models.AddOrderToAMQP(orderID)
-
-		fmt.Printf("[%s] orderid: %s mongo: %b amqp: %b\n", time.Now().Format(time.UnixDate), orderID, orderAddedToMongoDb, orderAddedToAMQP)
-		trackRequest(requestStartTime, time.Now(), orderAddedToMongoDb && orderAddedToAMQP, "POST", "captureorder.svc/orders/v1")
+		fmt.Printf("[%s] orderid: %s mongo: %t amqp: queued\n", time.Now().Format(time.UnixDate), orderID, orderAddedToMongoDb)
+		trackRequest(requestStartTime, time.Now(), orderAddedToMongoDb, "POST", "captureorder.svc/orders/v1")
 
 		// return
-		this.Data["json"] = map[string]string{"orderId": orderID}
+		response := map[string]string{"orderId": orderID}
+		if idempotencyKey != "" {
+			body, _ := json.Marshal(response)
+			if err := this.Idempotency.CompleteIdempotentRequest(idempotencyKey, reservation, orderID, 200, body); err != nil {
+				// The order exists, so keep the key reserved rather than let a retry create another one.
+				// Retries are refused until the reservation expires. If another request took the key
+				// over because this one was too slow, its response is kept.
+				fmt.Printf("[%s] correlationId: %s orderid: %s idempotent response not stored: %v\n", time.Now().Format(time.UnixDate), this.correlationID, orderID, err)
+			}
+		}
+		this.Data["json"] = response
+		this.ServeJSON()
 	} else {
-		this.Data["json"] = map[string]string{"error": "order not added to MongoDB. Check logs: " + err.Error()}
-		this.Ctx.Output.SetStatus(500)
+		if idempotencyKey != "" {
+			this.Idempotency.ReleaseIdempotentRequest(idempotencyKey, reservation)
+		}
 
-		fmt.Printf("[%s] orderid: %s mongo: %b amqp: %b\n", time.Now().Format(time.UnixDate), orderID, orderAddedToMongoDb, orderAddedToAMQP)
+		fmt.Printf("[%s] orderid: %s mongo: %t amqp: not queued\n", time.Now().Format(time.UnixDate), orderID, orderAddedToMongoDb)
 		trackRequest(requestStartTime, time.Now(), false, "POST", "captureorder.svc/orders/v1")
+
+		this.serveOrderError("order not added to MongoDB", err)
 	}
-	
+}
 
+// batchResult is the outcome of a single order of a batch
+type batchResult struct {
+	Index   int      `json:"index"`
+	OrderID string   `json:"orderId,omitempty"`
+	Problem *Problem `json:"problem,omitempty"`
+}
+
+// @Title Capture Order Batch
+// @Description Capture a batch of orders. Valid orders are stored even if others in the batch fail.
+// @Param	body	body 	[]models.Order true		"JSON array of orders"
+// @Param	Idempotency-Key	header	string	false	"retries with the same key return the original response"
+// @Success 200 every order was created
+// @Success 207 some orders were created, see the per order results
+// @Failure 400 the batch or every order in it is not valid
+// @Failure 409 a request with the same Idempotency-Key is in progress
+// @Failure 422 the Idempotency-Key was used with a different body
+// @Failure 500 no order was created, or some may have been, see the per order results
+// @router /batch [post]
+func (this *OrderController) PostBatch() {
+
+	// Track the request
+	requestStartTime := time.Now()
+
+	rawOrders, err := models.DecodeOrderBatch(this.Ctx.Input.RequestBody)
+	if err != nil {
+		this.serveProblem(this.validationProblem(err))
+		return
+	}
+
+	// Retries sent with the same Idempotency-Key get the original response instead of new orders
+	idempotencyKey := this.Ctx.Input.Header("Idempotency-Key")
+	reservation, replayed := this.replayIdempotentRequest(idempotencyKey, models.HashRequest(this.Ctx.Input.RequestBody))
+	if replayed {
+		return
+	}
+
+	// Validate every order, only the valid ones go to MongoDB
+	results := make([]batchResult, len(rawOrders))
+	var validOrders []models.Order
+	var validIndexes []int
+	for i, rawOrder := range rawOrders {
+		results[i].Index = i
+		ob, err := models.DecodeOrder(rawOrder)
+		if err != nil {
+			results[i].Problem = this.validationProblem(err)
+			continue
+		}
+		ob.CorrelationID = this.correlationID
+		validOrders = append(validOrders, ob)
+		validIndexes = append(validIndexes, i)
+	}
+
+	var created, failedInMongoDB, unknown int
+	if len(validOrders) > 0 {
+		orders, errs := this.Store.CreateMany(validOrders)
+		for j, i := range validIndexes {
+			if errs[j] == models.ErrOrderOutcomeUnknown {
+				// Report the ID so the client can check whether the order exists before sending it again
+				fmt.Printf("[%s] correlationId: %s batch index %d orderid: %s may not have been added to MongoDB\n", time.Now().Format(time.UnixDate), this.correlationID, i, orders[j].ID.Hex())
+				results[i].OrderID = orders[j].ID.Hex()
+				results[i].Problem = this.newProblem(problemInternal, "order may not have been added to MongoDB. Look it up by its orderId before sending it again.")
+				unknown++
+				continue
+			}
+			if errs[j] != nil {
+				fmt.Printf("[%s] correlationId: %s batch index %d not added to MongoDB: %v\n", time.Now().Format(time.UnixDate), this.correlationID, i, errs[j])
+				if _, throttled := errs[j].(*models.ThrottledError); throttled {
+					results[i].Problem = this.newProblem(problemThrottled, "order not added to MongoDB because the database is busy. Retry it later.")
+				} else {
+					results[i].Problem = this.newProblem(problemInternal, "order not added to MongoDB. Quote the correlation ID when reporting this error.")
+				}
+				failedInMongoDB++
+				continue
+			}
+			results[i].OrderID = orders[j].ID.Hex()
+			created++
+
+			// The outbox relay sends the order to AMQP
+			fmt.Printf("[%s] orderid: %s mongo: %t amqp: queued\n", time.Now().Format(time.UnixDate), results[i].OrderID, true)
+		}
+	}
+
+	statusCode := 400
+	switch {
+	case unknown > 0:
+		// The batch is indeterminate, a retry could store some orders twice
+		statusCode = 500
+	case created == len(results):
+		statusCode = 200
+	case created > 0:
+		statusCode = 207
+	case failedInMongoDB > 0:
+		statusCode = 500
+	}
+	trackRequest(requestStartTime, time.Now(), failedInMongoDB == 0 && unknown == 0, "POST", "captureorder.svc/orders/v1/batch")
+
+	response := map[string]interface{}{
+		"created": created,
+		"failed":  len(results) - created,
+		"results": results,
+	}
+	if idempotencyKey != "" {
+		if created == 0 && unknown == 0 {
+			// Nothing was stored, so the batch can be retried with the same key
+			this.Idempotency.ReleaseIdempotentRequest(idempotencyKey, reservation)
+		} else {
+			body, _ := json.Marshal(response)
+			if err := this.Idempotency.CompleteIdempotentRequest(idempotencyKey, reservation, "", statusCode, body); err != nil {
+				// Some orders exist, so keep the key reserved rather than let a retry create them again.
+				// Retries are refused until the reservation expires. If another request took the key
+				// over because this one was too slow, its response is kept.
+				fmt.Printf("[%s] correlationId: %s batch idempotent response not stored: %v\n", time.Now().Format(time.UnixDate), this.correlationID, err)
+			}
+		}
+	}
+	this.Ctx.Output.SetStatus(statusCode)
+	this.Data["json"] = response
 	this.ServeJSON()
 }
 
+// replayIdempotentRequest reserves the Idempotency-Key for this request, if it was sent, and returns the
+// reservation to complete or release. It returns true when the key was already used, after writing
+// the original response or an error, so the caller must stop.
+func (this *OrderController) replayIdempotentRequest(idempotencyKey string, requestHash string) (string, bool) {
+	if idempotencyKey == "" {
+		return "", false
+	}
+	existing, reservation, err := this.Idempotency.BeginIdempotentRequest(idempotencyKey, requestHash)
+
+	switch {
+	case err == models.ErrIdempotencyKeyTooLong:
+		this.serveProblem(this.newProblem(problemInvalidRequest, err.Error()))
+	case err != nil:
+		this.serveOrderError("couldn't check the Idempotency-Key", err)
+	case existing == nil:
+		// First time we see this key
+		return reservation, false
+	case existing.RequestHash != requestHash:
+		this.serveProblem(this.newProblem(problemIdempotencyKeyReuse, "Send a new Idempotency-Key for a different order."))
+	case existing.Pending():
+		this.serveProblem(this.newProblem(problemRequestInProgress, "Retry once the original request has completed."))
+	default:
+		this.Ctx.Output.Header("Idempotent-Replayed", "true")
+		this.Ctx.Output.Header("Content-Type", "application/json; charset=utf-8")
+		this.Ctx.Output.SetStatus(existing.StatusCode)
+		this.Ctx.Output.Body(existing.Response)
+	}
+	return "", true
+}
+
 // @Title Capture Order
 // @Description Capture order GET
 // @Success 200 {string} count of orders in the database
@@ -108,7 +288,7 @@ func (this *OrderController) Get() {
 	requestStartTime := time.Now()
 
 	// Get number of orders in MongoDB
-	orderCount, err := models.GetNumberOfOrdersInDB()
+	orderCount, err := this.Store.Count()
 	var orderCountQueried = false
 
 	if err == nil {
@@ -117,15 +297,299 @@ func (this *OrderController) Get() {
 
 		// return
 		this.Data["json"] = map[string]string{"orderCount": strconv.Itoa(orderCount), "timestamp": time.Now().String()}
+		this.ServeJSON()
 	} else {
-		this.Data["json"] = map[string]string{"error": "couldn't query order count. Check logs: " + err.Error()}
-		this.Ctx.Output.SetStatus(500)
 		trackRequest(requestStartTime, time.Now(), false, "GET", "captureorder.svc/orders/v1")
+		this.serveOrderError("couldn't query order count", err)
 	}
-	
+}
+
+// @Title Get Order
+// @Description Get a single order by ID
+// @Param	id	path	string	true	"the hex order id"
+// @Success 200 {object} models.Order
+// @Failure 400 id is not a valid order id
+// @Failure 404 order not found
+// @router /:id [get]
+func (this *OrderController) GetOrder() {
+
+	// Track the request
+	requestStartTime := time.Now()
+
+	orderID := this.Ctx.Input.Param(":id")
+	order, err := this.Store.Get(orderID)
+
+	trackRequest(requestStartTime, time.Now(), !isInternalError(err), "GET", "captureorder.svc/orders/v1/"+orderID)
+
+	if err != nil {
+		this.serveOrderError("couldn't retrieve order", err)
+		return
+	}
+
+	this.serveOrder(order)
+}
+
+// statusRequest is the body accepted by UpdateStatus
+type statusRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+	Actor  string `json:"actor"`
+}
+
+// cancelRequest is the body accepted by Cancel
+type cancelRequest struct {
+	Reason string `json:"reason"`
+	Actor  string `json:"actor"`
+}
+
+// @Title Update Order Status
+// @Description Move an order to a new status in its lifecycle
+// @Param	id	path	string	true	"the hex order id"
+// @Param	body	body	controllers.statusRequest	true	"the new status and an optional reason"
+// @Param	If-Match	header	string	false	"only update the order if it still has this ETag"
+// @Success 200 {object} models.Order
+// @Failure 400 invalid id, body, status or If-Match, or Cancelled, which goes through /:id/cancel
+// @Failure 404 order not found
+// @Failure 409 the order can't move to the requested status
+// @Failure 412 the order no longer has the ETag in If-Match
+// @router /:id/status [post]
+func (this *OrderController) UpdateStatus() {
+
+	// Track the request
+	requestStartTime := time.Now()
+
+	orderID := this.Ctx.Input.Param(":id")
+
+	var req statusRequest
+	err := json.Unmarshal(this.Ctx.Input.RequestBody, &req)
+	if err != nil {
+		this.serveProblem(this.newProblem(problemInvalidRequest, "request body is not a valid status request"))
+		return
+	}
+	version, err := parseIfMatch(this.Ctx.Input.Header("If-Match"))
+	if err != nil {
+		this.serveProblem(this.newProblem(problemInvalidRequest, err.Error()))
+		return
+	}
+
+	order, err := models.TransitionOrderStatus(this.Store, orderID, version, req.Status, req.Reason, req.Actor)
+	trackRequest(requestStartTime, time.Now(), !isInternalError(err), "POST", "captureorder.svc/orders/v1/"+orderID+"/status")
+
+	if err != nil {
+		this.serveOrderError("couldn't update order status", err)
+		return
+	}
+
+	this.serveOrder(order)
+}
+
+// @Title Cancel Order
+// @Description Cancel an order that is not fulfilled yet and tell fulfillment to stop work on it
+// @Param	id	path	string	true	"the hex order id"
+// @Param	body	body	controllers.cancelRequest	true	"why the order is cancelled and who cancelled it"
+// @Param	If-Match	header	string	false	"only cancel the order if it still has this ETag"
+// @Success 200 {object} models.Order
+// @Failure 400 invalid id, body or If-Match
+// @Failure 404 order not found
+// @Failure 409 the order can no longer be cancelled
+// @Failure 412 the order no longer has the ETag in If-Match
+// @router /:id/cancel [post]
+func (this *OrderController) Cancel() {
+
+	// Track the request
+	requestStartTime := time.Now()
+
+	orderID := this.Ctx.Input.Param(":id")
+
+	var req cancelRequest
+	err := json.Unmarshal(this.Ctx.Input.RequestBody, &req)
+	if err != nil {
+		this.serveProblem(this.newProblem(problemInvalidRequest, "request body is not a valid cancel request"))
+		return
+	}
+	version, err := parseIfMatch(this.Ctx.Input.Header("If-Match"))
+	if err != nil {
+		this.serveProblem(this.newProblem(problemInvalidRequest, err.Error()))
+		return
+	}
+
+	order, err := models.CancelOrder(this.Store, orderID, version, req.Reason, req.Actor, this.correlationID)
+	trackRequest(requestStartTime, time.Now(), !isInternalError(err), "POST", "captureorder.svc/orders/v1/"+orderID+"/cancel")
+
+	if err != nil {
+		this.serveOrderError("couldn't cancel order", err)
+		return
+	}
+
+	// The outbox relay compensates for the order created message so fulfillment stops work
+	fmt.Printf("[%s] orderid: %s cancelled amqp: queued\n", time.Now().Format(time.UnixDate), orderID)
+
+	this.serveOrder(order)
+}
+
+// @Title List Orders
+// @Description List orders page by page, optionally filtered
+// @Param	status	query	string	false	"only return orders with this status"
+// @Param	product	query	string	false	"only return orders for this product"
+// @Param	emailAddress	query	string	false	"only return orders for this email address"
+// @Param	createdFrom	query	string	false	"RFC 3339 time, only return orders created at or after it"
+// @Param	createdTo	query	string	false	"RFC 3339 time, only return orders created before it"
+// @Param	sort	query	string	false	"createdAt (oldest first) or -createdAt (newest first, default)"
+// @Param	limit	query	int	false	"page size, defaults to 20 and is capped at 100"
+// @Param	cursor	query	string	false	"nextCursor returned by the previous page"
+// @Success 200 {object} models.OrderPage
+// @Failure 400 invalid query parameter
+// @router /list [get]
+func (this *OrderController) List() {
+
+	// Track the request
+	requestStartTime := time.Now()
+
+	var page models.OrderPage
+	filter, err := parseOrderFilter(this)
+	if err == nil {
+		page, err = this.Store.List(filter)
+	}
+
+	trackRequest(requestStartTime, time.Now(), !isInternalError(err), "GET", "captureorder.svc/orders/v1/list")
+
+	if err != nil {
+		this.serveOrderError("couldn't list orders", err)
+		return
+	}
+
+	this.Data["json"] = page
 	this.ServeJSON()
 }
 
+// @Title Customer Order History
+// @Description Get the orders of a customer, newest first, with their order count and lifetime value
+// @Param	emailAddress	query	string	true	"the customer's email address, matched case-insensitively"
+// @Param	limit	query	int	false	"most orders to return, defaults to 50 and is capped at 200"
+// @Success 200 {object} models.CustomerOrderHistory
+// @Failure 400 invalid email address or limit
+// @router /customer [get]
+func (this *OrderController) CustomerHistory() {
+
+	// Track the request
+	requestStartTime := time.Now()
+
+	var history models.CustomerOrderHistory
+	limit, err := this.GetInt("limit", 0)
+	if err != nil || limit < 0 {
+		err = &queryError{"limit", this.GetString("limit")}
+	} else {
+		history, err = models.GetCustomerOrderHistory(this.Store, this.GetString("emailAddress"), limit)
+	}
+	trackRequest(requestStartTime, time.Now(), !isInternalError(err), "GET", "captureorder.svc/orders/v1/customer")
+
+	if err != nil {
+		this.serveOrderError("couldn't retrieve customer orders", err)
+		return
+	}
+
+	this.Data["json"] = history
+	this.ServeJSON()
+}
+
+// queryError reports a query string parameter that couldn't be parsed
+type queryError struct {
+	param string
+	value string
+}
+
+func (e *queryError) Error() string {
+	return fmt.Sprintf("invalid value %q for query parameter %s", e.value, e.param)
+}
+
+// serveOrderError maps the errors returned by the models package to problems.
+// Anything unexpected is served as an internal error described by detail.
+func (this *OrderController) serveOrderError(detail string, err error) {
+	switch e := err.(type) {
+	case *models.ValidationError:
+		this.serveProblem(this.validationProblem(e))
+	case *models.TransitionError:
+		problem := this.newProblem(problemInvalidTransition, e.Error())
+		problem.CurrentStatus = e.From
+		problem.AllowedStatuses = e.Allowed
+		this.serveProblem(problem)
+	case *models.StaleVersionError:
+		problem := this.newProblem(problemStaleVersion, e.Error()+". Get the order again before updating it.")
+		problem.CurrentVersion = &e.Current
+		this.Ctx.Output.Header("ETag", orderETag(models.Order{Version: e.Current}))
+		this.serveProblem(problem)
+	case *queryError:
+		this.serveProblem(this.newProblem(problemInvalidRequest, e.Error()))
+	case *models.ThrottledError:
+		this.serveThrottled(e)
+	default:
+		switch err {
+		case models.ErrInvalidOrderID, models.ErrInvalidStatus, models.ErrInvalidCursor:
+			this.serveProblem(this.newProblem(problemInvalidRequest, err.Error()))
+		case models.ErrCancelWithCancelOrder:
+			this.serveProblem(this.newProblem(problemInvalidRequest, "Cancel orders with POST /v1/order/{id}/cancel, which records why and by whom and tells fulfillment."))
+		case models.ErrOrderNotFound:
+			this.serveProblem(this.newProblem(problemNotFound, ""))
+		case models.ErrVersionConflict:
+			this.serveProblem(this.newProblem(problemConcurrentUpdate, "Get the order again and retry the update."))
+		default:
+			this.serveInternalError(detail, err)
+		}
+	}
+}
+
+// isInternalError reports whether err is a server side failure rather than a problem with the request
+func isInternalError(err error) bool {
+	switch err.(type) {
+	case nil, *models.ValidationError, *models.TransitionError, *models.StaleVersionError, *queryError:
+		return false
+	}
+	switch err {
+	case models.ErrInvalidOrderID, models.ErrInvalidStatus, models.ErrInvalidCursor, models.ErrOrderNotFound, models.ErrVersionConflict, models.ErrCancelWithCancelOrder:
+		return false
+	}
+	return true
+}
+
+// parseOrderFilter builds a models.OrderFilter from the request query string
+func parseOrderFilter(this *OrderController) (models.OrderFilter, error) {
+	filter := models.OrderFilter{
+		Status:       this.GetString("status"),
+		Product:      this.GetString("product"),
+		EmailAddress: this.GetString("emailAddress"),
+		Cursor:       this.GetString("cursor"),
+		NewestFirst:  true,
+	}
+
+	for param, value := range map[string]*time.Time{"createdFrom": &filter.CreatedFrom, "createdTo": &filter.CreatedTo} {
+		if raw := this.GetString(param); raw != "" {
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				return filter, &queryError{param, raw}
+			}
+			*value = t
+		}
+	}
+
+	switch sort := this.GetString("sort"); sort {
+	case "", "-createdAt":
+	case "createdAt":
+		filter.NewestFirst = false
+	default:
+		return filter, &queryError{"sort", sort}
+	}
+
+	if raw := this.GetString("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			return filter, &queryError{"limit", raw}
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
+
 func trackRequest(requestStartTime time.Time, requestEndTime time.Time, requestSuccess bool, method string, endpoint string) {
 	var responseCode = "200"
 	if requestSuccess != true {
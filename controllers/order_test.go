@@ -0,0 +1,319 @@
+package controllers
+
+import (
+	"captureorderfd/models"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/astaxie/beego"
+)
+
+// newTestHandler routes the order API to a controller backed by a fresh in-memory store
+func newTestHandler() http.Handler {
+	store := models.NewMemoryOrderStore()
+	return newStoreHandler(store, store)
+}
+
+// newStoreHandler routes the order API to a controller backed by the given stores
+func newStoreHandler(store models.OrderStore, idempotency models.IdempotencyStore) http.Handler {
+	beego.BConfig.CopyRequestBody = true
+	beego.BConfig.RunMode = beego.PROD
+
+	controller := &OrderController{Store: store, Idempotency: idempotency}
+
+	handler := beego.NewControllerRegister()
+	handler.Add("/v1/order", controller, "post:Post;get:Get")
+	handler.Add("/v1/order/batch", controller, "post:PostBatch")
+	handler.Add("/v1/order/list", controller, "get:List")
+	handler.Add("/v1/order/customer", controller, "get:CustomerHistory")
+	handler.Add("/v1/order/:id", controller, "get:GetOrder")
+	handler.Add("/v1/order/:id/status", controller, "post:UpdateStatus")
+	handler.Add("/v1/order/:id/cancel", controller, "post:Cancel")
+	return handler
+}
+
+func serve(handler http.Handler, method string, url string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPostAndGetOrder(t *testing.T) {
+	handler := newTestHandler()
+
+	rec := serve(handler, "POST", "/v1/order", `{"emailAddress": "jane@example.com", "items": [{"sku": "sku-1", "quantity": 2, "unitPrice": 1.5}]}`, nil)
+	if rec.Code != 200 {
+		t.Fatalf("POST returned %d: %s", rec.Code, rec.Body)
+	}
+	var added map[string]string
+	json.Unmarshal(rec.Body.Bytes(), &added)
+
+	rec = serve(handler, "GET", "/v1/order/"+added["orderId"], "", nil)
+	if rec.Code != 200 {
+		t.Fatalf("GET returned %d: %s", rec.Code, rec.Body)
+	}
+	var order models.Order
+	json.Unmarshal(rec.Body.Bytes(), &order)
+	if order.ID.Hex() != added["orderId"] || order.Status != models.StatusOpen || order.Total != 3 {
+		t.Errorf("GET returned %+v", order)
+	}
+
+	rec = serve(handler, "GET", "/v1/order", "", nil)
+	var count map[string]string
+	json.Unmarshal(rec.Body.Bytes(), &count)
+	if count["orderCount"] != "1" {
+		t.Errorf("Count returned %s", rec.Body)
+	}
+}
+
+func TestPostInvalidOrder(t *testing.T) {
+	handler := newTestHandler()
+
+	rec := serve(handler, "POST", "/v1/order", `{"emailAddress": "not an address", "product": "sku-1"}`, nil)
+	if rec.Code != 400 || !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/problem+json") {
+		t.Fatalf("POST of an invalid order returned %d %s: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	var problem Problem
+	json.Unmarshal(rec.Body.Bytes(), &problem)
+	if len(problem.Errors) != 1 || problem.Errors[0].Field != "emailAddress" {
+		t.Errorf("POST of an invalid order returned %+v", problem)
+	}
+}
+
+func TestPostIdempotencyKey(t *testing.T) {
+	handler := newTestHandler()
+	body := `{"emailAddress": "jane@example.com", "product": "sku-1", "total": 10}`
+	headers := map[string]string{"Idempotency-Key": "retry-me"}
+
+	first := serve(handler, "POST", "/v1/order", body, headers)
+	retry := serve(handler, "POST", "/v1/order", body, headers)
+	if retry.Code != 200 || retry.Body.String() != first.Body.String() || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Retry returned %d %s, expected the original %s", retry.Code, retry.Body, first.Body)
+	}
+
+	reused := serve(handler, "POST", "/v1/order", `{"emailAddress": "jane@example.com", "product": "sku-2", "total": 10}`, headers)
+	if reused.Code != 422 {
+		t.Errorf("Reusing the key for another order returned %d", reused.Code)
+	}
+
+	rec := serve(handler, "GET", "/v1/order/list", "", nil)
+	var page models.OrderPage
+	json.Unmarshal(rec.Body.Bytes(), &page)
+	if len(page.Orders) != 1 {
+		t.Errorf("Retries created %d orders, expected 1", len(page.Orders))
+	}
+}
+
+// batchResponse is the body returned by PostBatch
+type batchResponse struct {
+	Created int           `json:"created"`
+	Failed  int           `json:"failed"`
+	Results []batchResult `json:"results"`
+}
+
+func TestPostBatch(t *testing.T) {
+	handler := newTestHandler()
+	body := `[
+		{"emailAddress": "jane@example.com", "items": [{"sku": "sku-1", "quantity": 2, "unitPrice": 1.5}]},
+		{"emailAddress": "not an address", "product": "sku-1"},
+		{"emailAddress": "john@example.com", "product": "sku-2", "total": 10}
+	]`
+	headers := map[string]string{"Idempotency-Key": "batch-1"}
+
+	// Valid orders are created even though another one in the batch isn't valid
+	rec := serve(handler, "POST", "/v1/order/batch", body, headers)
+	var response batchResponse
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	if rec.Code != 207 || response.Created != 2 || response.Failed != 1 || len(response.Results) != 3 {
+		t.Fatalf("POST of a partly valid batch returned %d: %s", rec.Code, rec.Body)
+	}
+	for i, result := range response.Results {
+		if result.Index != i {
+			t.Errorf("Result %d is for the order at index %d", i, result.Index)
+		}
+	}
+	if response.Results[0].OrderID == "" || response.Results[2].OrderID == "" || response.Results[0].Problem != nil {
+		t.Errorf("The valid orders have the results %+v and %+v", response.Results[0], response.Results[2])
+	}
+	if problem := response.Results[1].Problem; response.Results[1].OrderID != "" || problem == nil || len(problem.Errors) != 1 || problem.Errors[0].Field != "emailAddress" {
+		t.Errorf("The invalid order has the result %+v", response.Results[1])
+	}
+
+	// A retry with the same Idempotency-Key gets the original response without creating the orders again
+	retry := serve(handler, "POST", "/v1/order/batch", body, headers)
+	if retry.Code != 207 || retry.Body.String() != rec.Body.String() || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Retry returned %d %s, expected the original %s", retry.Code, retry.Body, rec.Body)
+	}
+	rec = serve(handler, "GET", "/v1/order/list", "", nil)
+	var page models.OrderPage
+	json.Unmarshal(rec.Body.Bytes(), &page)
+	if len(page.Orders) != 2 {
+		t.Errorf("The batch and its retry created %d orders, expected 2", len(page.Orders))
+	}
+
+	// A batch in which nothing was created can be fixed and sent again with the same key
+	headers = map[string]string{"Idempotency-Key": "batch-2"}
+	rec = serve(handler, "POST", "/v1/order/batch", `[{"emailAddress": "not an address", "product": "sku-1"}]`, headers)
+	if rec.Code != 400 {
+		t.Errorf("POST of a batch without a valid order returned %d: %s", rec.Code, rec.Body)
+	}
+	rec = serve(handler, "POST", "/v1/order/batch", `[{"emailAddress": "jane@example.com", "product": "sku-1", "total": 10}]`, headers)
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	if rec.Code != 200 || response.Created != 1 || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("POST of the fixed batch with the same key returned %d: %s", rec.Code, rec.Body)
+	}
+}
+
+// unknownOutcomeStore stores batches in memory but can't tell whether their last order was stored
+type unknownOutcomeStore struct {
+	*models.MemoryOrderStore
+}
+
+func (s unknownOutcomeStore) CreateMany(orders []models.Order) ([]models.Order, []error) {
+	orders, errs := s.MemoryOrderStore.CreateMany(orders)
+	errs[len(errs)-1] = models.ErrOrderOutcomeUnknown
+	return orders, errs
+}
+
+func TestPostBatchUnknownOutcome(t *testing.T) {
+	store := unknownOutcomeStore{models.NewMemoryOrderStore()}
+	handler := newStoreHandler(store, store)
+	body := `[
+		{"emailAddress": "jane@example.com", "product": "sku-1", "total": 10},
+		{"emailAddress": "john@example.com", "product": "sku-2", "total": 10}
+	]`
+	headers := map[string]string{"Idempotency-Key": "batch-1"}
+
+	// The whole batch fails rather than report the order as not created
+	rec := serve(handler, "POST", "/v1/order/batch", body, headers)
+	var response batchResponse
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	if rec.Code != 500 || response.Created != 1 || len(response.Results) != 2 {
+		t.Fatalf("POST of a batch with an unknown outcome returned %d: %s", rec.Code, rec.Body)
+	}
+	if result := response.Results[1]; result.OrderID == "" || result.Problem == nil {
+		t.Errorf("The order with an unknown outcome has the result %+v", result)
+	}
+
+	// and its key is kept so that a retry doesn't store the orders again
+	retry := serve(handler, "POST", "/v1/order/batch", body, headers)
+	if retry.Code != 500 || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Retry returned %d %s, expected the original response", retry.Code, retry.Body)
+	}
+}
+
+func TestPostInvalidBatch(t *testing.T) {
+	defer func(limit int) { models.MaxOrderBatchSize = limit }(models.MaxOrderBatchSize)
+	models.MaxOrderBatchSize = 2
+	handler := newTestHandler()
+
+	order := `{"emailAddress": "jane@example.com", "product": "sku-1", "total": 10}`
+	for name, body := range map[string]string{
+		"empty":     "",
+		"not array": order,
+		"no orders": "[]",
+		"too large": "[" + strings.Repeat(order+",", models.MaxOrderBatchSize) + order + "]",
+	} {
+		rec := serve(handler, "POST", "/v1/order/batch", body, nil)
+		var problem Problem
+		json.Unmarshal(rec.Body.Bytes(), &problem)
+		if rec.Code != 400 || len(problem.Errors) != 1 || problem.Errors[0].Field != "body" {
+			t.Errorf("POST of a batch that is %s returned %d: %s", name, rec.Code, rec.Body)
+		}
+	}
+
+	rec := serve(handler, "POST", "/v1/order/batch", "["+strings.Repeat(order+",", models.MaxOrderBatchSize-1)+order+"]", nil)
+	if rec.Code != 200 {
+		t.Errorf("POST of a batch at the limit returned %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestOrderLifecycle(t *testing.T) {
+	handler := newTestHandler()
+
+	rec := serve(handler, "POST", "/v1/order", `{"emailAddress": "jane@example.com", "product": "sku-1", "total": 10}`, nil)
+	var added map[string]string
+	json.Unmarshal(rec.Body.Bytes(), &added)
+	orderURL := "/v1/order/" + added["orderId"]
+
+	rec = serve(handler, "POST", orderURL+"/status", `{"status": "Confirmed", "actor": "billing"}`, nil)
+	if rec.Code != 200 {
+		t.Fatalf("Confirming returned %d: %s", rec.Code, rec.Body)
+	}
+
+	// Cancelling needs a reason and an actor, so it can't be done by changing the status
+	rec = serve(handler, "POST", orderURL+"/status", `{"status": "Cancelled"}`, nil)
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), "/cancel") {
+		t.Errorf("Cancelling through the status returned %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(handler, "POST", orderURL+"/cancel", `{"reason": "changed my mind", "actor": "jane"}`, nil)
+	if rec.Code != 200 {
+		t.Fatalf("Cancelling returned %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(handler, "POST", orderURL+"/status", `{"status": "Fulfilled", "actor": "warehouse"}`, nil)
+	var problem Problem
+	json.Unmarshal(rec.Body.Bytes(), &problem)
+	if rec.Code != 409 || problem.CurrentStatus != models.StatusCancelled {
+		t.Errorf("Fulfilling a cancelled order returned %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(handler, "GET", "/v1/order/customer?emailAddress=JANE@example.com", "", nil)
+	var history models.CustomerOrderHistory
+	json.Unmarshal(rec.Body.Bytes(), &history)
+	if rec.Code != 200 || history.OrderCount != 1 || history.LifetimeValue != 0 {
+		t.Errorf("Customer history returned %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestOrderIfMatch(t *testing.T) {
+	handler := newTestHandler()
+
+	rec := serve(handler, "POST", "/v1/order", `{"emailAddress": "jane@example.com", "product": "sku-1", "total": 10}`, nil)
+	var added map[string]string
+	json.Unmarshal(rec.Body.Bytes(), &added)
+	orderURL := "/v1/order/" + added["orderId"]
+
+	rec = serve(handler, "GET", orderURL, "", nil)
+	etag := rec.Header().Get("ETag")
+	if etag != `"1"` {
+		t.Fatalf("GET returned the ETag %s, expected \"1\"", etag)
+	}
+
+	rec = serve(handler, "POST", orderURL+"/status", `{"status": "Confirmed", "actor": "billing"}`, map[string]string{"If-Match": etag})
+	if rec.Code != 200 || rec.Header().Get("ETag") != `"2"` {
+		t.Fatalf("Confirming at the current ETag returned %d %s: %s", rec.Code, rec.Header().Get("ETag"), rec.Body)
+	}
+
+	// The ETag read before the order was confirmed is stale
+	rec = serve(handler, "POST", orderURL+"/cancel", `{"reason": "changed my mind", "actor": "jane"}`, map[string]string{"If-Match": etag})
+	var problem Problem
+	json.Unmarshal(rec.Body.Bytes(), &problem)
+	if rec.Code != 412 || problem.CurrentVersion == nil || *problem.CurrentVersion != 2 || rec.Header().Get("ETag") != `"2"` {
+		t.Errorf("Cancelling at a stale ETag returned %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(handler, "POST", orderURL+"/cancel", `{"reason": "changed my mind", "actor": "jane"}`, map[string]string{"If-Match": `W/"2"`})
+	if rec.Code != 400 {
+		t.Errorf("Cancelling with a weak ETag returned %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestGetUnknownOrder(t *testing.T) {
+	handler := newTestHandler()
+
+	rec := serve(handler, "GET", "/v1/order/5b9f2c3e8d1a4f0001a1b2c3", "", map[string]string{CorrelationIDHeader: "test-correlation"})
+	var problem Problem
+	json.Unmarshal(rec.Body.Bytes(), &problem)
+	if rec.Code != 404 || problem.CorrelationID != "test-correlation" {
+		t.Errorf("GET of an unknown order returned %d: %s", rec.Code, rec.Body)
+	}
+}
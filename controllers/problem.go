@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"captureorderfd/models"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// CorrelationIDHeader carries the ID used to correlate a request with its logs and problem responses.
+// A client supplied ID is kept, otherwise one is generated.
+const CorrelationIDHeader = "X-Correlation-ID"
+
+// problemTypeBase prefixes the stable type URI of every problem
+const problemTypeBase = "urn:captureorder:problem:"
+
+// problemType is a kind of error the API reports, identified by a stable type URI
+type problemType struct {
+	slug   string
+	title  string
+	status int
+}
+
+// Problem types reported by the API. The slugs are part of the API contract, don't rename them.
+var (
+	problemInvalidRequest      = problemType{"invalid-request", "The request is not valid.", 400}
+	problemValidation          = problemType{"validation-error", "The order is not valid.", 400}
+	problemNotFound            = problemType{"not-found", "The order was not found.", 404}
+	problemInvalidTransition   = problemType{"invalid-transition", "The order can't move to the requested status.", 409}
+	problemRequestInProgress   = problemType{"request-in-progress", "A request with this Idempotency-Key is still being processed.", 409}
+	problemIdempotencyKeyReuse = problemType{"idempotency-key-reused", "The Idempotency-Key was already used with a different request.", 422}
+	problemConcurrentUpdate    = problemType{"concurrent-update", "The order kept being changed by other requests.", 409}
+	problemStaleVersion        = problemType{"stale-version", "The order was changed since the version in If-Match.", 412}
+	problemInternal            = problemType{"internal-error", "An unexpected error occurred.", 500}
+	problemThrottled           = problemType{"throttled", "The database is too busy to handle the request right now.", 503}
+)
+
+// Problem is an RFC 7807 problem details response, served as application/problem+json
+type Problem struct {
+	Type          string              `json:"type"`
+	Title         string              `json:"title"`
+	Status        int                 `json:"status"`
+	Detail        string              `json:"detail,omitempty"`
+	Instance      string              `json:"instance,omitempty"`
+	CorrelationID string              `json:"correlationId"`
+	Errors        []models.FieldError `json:"errors,omitempty"`
+
+	// Set for invalid-transition problems
+	CurrentStatus   string   `json:"currentStatus,omitempty"`
+	AllowedStatuses []string `json:"allowedStatuses,omitempty"`
+
+	// Set for stale-version problems
+	CurrentVersion *int64 `json:"currentVersion,omitempty"`
+}
+
+// Prepare runs before every action and makes sure the request has a correlation ID
+func (this *OrderController) Prepare() {
+	this.correlationID = this.Ctx.Input.Header(CorrelationIDHeader)
+	if this.correlationID == "" || len(this.correlationID) > 128 {
+		this.correlationID = newCorrelationID()
+	}
+	this.Ctx.Output.Header(CorrelationIDHeader, this.correlationID)
+}
+
+// newProblem builds a problem of the given type for the current request
+func (this *OrderController) newProblem(t problemType, detail string) *Problem {
+	return &Problem{
+		Type:          problemTypeBase + t.slug,
+		Title:         t.title,
+		Status:        t.status,
+		Detail:        detail,
+		Instance:      this.Ctx.Input.URI(),
+		CorrelationID: this.correlationID,
+	}
+}
+
+// serveProblem writes the problem as the response
+func (this *OrderController) serveProblem(problem *Problem) {
+	body, _ := json.Marshal(problem)
+	this.Ctx.Output.Header("Content-Type", "application/problem+json; charset=utf-8")
+	this.Ctx.Output.SetStatus(problem.Status)
+	this.Ctx.Output.Body(body)
+}
+
+// serveInternalError logs err against the correlation ID and serves a problem that doesn't leak it
+func (this *OrderController) serveInternalError(detail string, err error) {
+	fmt.Printf("[%s] correlationId: %s %s: %v\n", time.Now().Format(time.UnixDate), this.correlationID, detail, err)
+	this.serveProblem(this.newProblem(problemInternal, detail+". Quote the correlation ID when reporting this error."))
+}
+
+// serveThrottled tells the client when to retry an operation the database kept throttling
+func (this *OrderController) serveThrottled(err *models.ThrottledError) {
+	fmt.Printf("[%s] correlationId: %s %v\n", time.Now().Format(time.UnixDate), this.correlationID, err)
+	this.Ctx.Output.Header("Retry-After", strconv.Itoa(retryAfterSeconds(err.RetryAfter)))
+	this.serveProblem(this.newProblem(problemThrottled, "Retry the request after the number of seconds in the Retry-After header."))
+}
+
+// retryAfterSeconds rounds a delay up to whole seconds for the Retry-After header
+func retryAfterSeconds(d time.Duration) int {
+	seconds := int((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// validationProblem describes a *models.ValidationError
+func (this *OrderController) validationProblem(err error) *Problem {
+	problem := this.newProblem(problemValidation, "")
+	if validationErr, ok := err.(*models.ValidationError); ok {
+		problem.Detail = fmt.Sprintf("%d field(s) failed validation.", len(validationErr.Errors))
+		problem.Errors = validationErr.Errors
+	} else {
+		problem.Detail = err.Error()
+	}
+	return problem
+}
+
+// newCorrelationID generates a random 128 bit ID
+func newCorrelationID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
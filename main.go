@@ -1,12 +1,38 @@
 package main
 
 import (
-	_ "captureorderfd/routers"
+	"captureorderfd/models"
+	"captureorderfd/routers"
+	"log"
+	"os"
 
 	"github.com/astaxie/beego"
 )
 
 func main() {
+	// "captureorderfd migrate" brings the order store's schema and indexes up to date and exits,
+	// so it can run as a deployment step before the API starts
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := models.MigrateOrderStore(); err != nil {
+			log.Fatal("Migration failed: ", err)
+		}
+		log.Println("Migration complete")
+		return
+	}
+
+	// "captureorderfd archive" archives the orders past their retention once and exits,
+	// so it can run as a scheduled job instead of inside the API
+	if len(os.Args) > 1 && os.Args[1] == "archive" {
+		report, err := models.RunRetention()
+		if err != nil {
+			log.Fatal("Retention failed: ", err)
+		}
+		log.Printf("Retention complete: %d orders archived", report.Archived)
+		return
+	}
+
+	routers.RouteOrders()
+
 	if beego.BConfig.RunMode == "dev" {
 		beego.BConfig.WebConfig.DirectoryIndex = true
 		beego.BConfig.WebConfig.StaticDir["/swagger"] = "swagger"
@@ -0,0 +1,182 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrOrderOutcomeUnknown is returned for an order of a batch that may or may not have been stored
+var ErrOrderOutcomeUnknown = errors.New("order may have been stored")
+
+// MaxOrderBatchSize is the most orders accepted in one batch.
+// Override with the ORDER_BATCH_LIMIT environment variable.
+var MaxOrderBatchSize = 100
+
+// DecodeOrderBatch splits a JSON array of orders into the raw orders so each can be
+// decoded and validated on its own with DecodeOrder.
+func DecodeOrderBatch(body []byte) ([]json.RawMessage, error) {
+	var orders []json.RawMessage
+
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, &ValidationError{[]FieldError{{"body", FieldErrorRequired, "request body is empty"}}}
+	}
+	if err := json.Unmarshal(body, &orders); err != nil {
+		return nil, &ValidationError{[]FieldError{{"body", FieldErrorMalformed, "request body must be a JSON array of orders"}}}
+	}
+	if len(orders) == 0 {
+		return nil, &ValidationError{[]FieldError{{"body", FieldErrorRequired, "batch has no orders"}}}
+	}
+	if len(orders) > MaxOrderBatchSize {
+		return nil, &ValidationError{[]FieldError{{"body", FieldErrorInvalid, fmt.Sprintf("batch must not have more than %d orders", MaxOrderBatchSize)}}}
+	}
+	return orders, nil
+}
+
+// CreateMany inserts a batch of orders into MongoDB/CosmosDB with a single unordered bulk insert,
+// each with its outbox message embedded, see mongoOrderDocument. It returns every order as stored and,
+// at the same index, the error for each order that couldn't be inserted. Orders without an error were inserted.
+func (s *MongoOrderStore) CreateMany(orders []Order) ([]Order, []error) {
+	errs := make([]error, len(orders))
+
+	docs := make([]interface{}, len(orders))
+	for i := range orders {
+		prepareNewOrder(&orders[i])
+		docs[i] = newMongoOrderDocument(orders[i])
+	}
+
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	log.Println("Bulk inserting into MongoDB URL: ", mongoHost, " CosmosDB: ", isCosmosDb)
+
+	// Unordered so that one failing order doesn't stop the rest of the batch. CosmosDB may throttle
+	// only some of the orders, so only those are sent again, the others were inserted or failed for good.
+	pending := make([]int, len(orders))
+	for i := range pending {
+		pending[i] = i
+	}
+	unattributed := false
+	err := retryThrottled(ctx, "bulk insert orders", func() error {
+		batch := make([]interface{}, len(pending))
+		for j, i := range pending {
+			batch[j] = docs[i]
+		}
+		_, err := s.orders().InsertMany(ctx, batch, options.InsertMany().SetOrdered(false))
+		if err == nil {
+			for _, i := range pending {
+				errs[i] = nil
+			}
+			pending = nil
+			return nil
+		}
+
+		batchErrs := make([]error, len(pending))
+		if !attributeBulkErrors(err, batchErrs) {
+			unattributed = true
+			return err
+		}
+		unattributed = false
+		var throttled []int
+		var throttledErr error
+		for j, i := range pending {
+			errs[i] = batchErrs[j]
+			if _, isThrottled := throttleRetryAfter(batchErrs[j]); isThrottled {
+				throttled = append(throttled, i)
+				throttledErr = err
+			}
+		}
+		pending = throttled
+		return throttledErr
+	})
+
+	if err != nil {
+		printErr("Problem bulk inserting orders: ", err)
+		for _, i := range pending {
+			errs[i] = err
+		}
+		if unattributed {
+			// Can't tell which orders failed, some may have been inserted before the error
+			s.findInsertedOrders(orders, pending, errs)
+		}
+	}
+
+	log.Println("Bulk inserted orders:", countNil(errs), "of", len(orders))
+	return orders, errs
+}
+
+// findInsertedOrders clears the errors of the pending orders that are in MongoDB after all, so they aren't
+// reported as failed and inserted again by a retry. If they can't be looked up, their outcome is unknown.
+func (s *MongoOrderStore) findInsertedOrders(orders []Order, pending []int, errs []error) {
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	ids := make([]primitive.ObjectID, len(pending))
+	for j, i := range pending {
+		ids[j] = orders[i].ID
+	}
+	var inserted []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	err := retryThrottled(ctx, "find inserted orders", func() error {
+		cursor, err := s.orders().Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"_id": 1}))
+		if err != nil {
+			return err
+		}
+		return cursor.All(ctx, &inserted)
+	})
+	if err != nil {
+		printErr("Problem finding the inserted orders: ", err)
+		for _, i := range pending {
+			errs[i] = ErrOrderOutcomeUnknown
+		}
+		return
+	}
+
+	found := make(map[primitive.ObjectID]bool, len(inserted))
+	for _, order := range inserted {
+		found[order.ID] = true
+	}
+	for _, i := range pending {
+		if found[orders[i].ID] {
+			errs[i] = nil
+		}
+	}
+}
+
+// attributeBulkErrors copies the failure of each order in a mongo.BulkWriteException to errs.
+// It returns false when the failures can't be matched to orders.
+func attributeBulkErrors(err error, errs []error) bool {
+	bulkErr, ok := err.(mongo.BulkWriteException)
+	if !ok || bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) == 0 {
+		return false
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Index < 0 || writeErr.Index >= len(errs) {
+			return false
+		}
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		errs[writeErr.Index] = writeErr
+	}
+	return true
+}
+
+// countNil counts the operations that succeeded
+func countNil(errs []error) int {
+	n := 0
+	for _, err := range errs {
+		if err == nil {
+			n++
+		}
+	}
+	return n
+}
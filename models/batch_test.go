@@ -0,0 +1,38 @@
+package models
+
+import (
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestAttributeBulkErrors(t *testing.T) {
+	throttled := mongo.BulkWriteError{WriteError: mongo.WriteError{Index: 2, Code: cosmosThrottledCode, Message: "Request rate is large. RetryAfterMs=100"}}
+	duplicate := mongo.BulkWriteError{WriteError: mongo.WriteError{Index: 0, Code: 11000, Message: "duplicate key"}}
+
+	errs := make([]error, 3)
+	if !attributeBulkErrors(mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{duplicate, throttled}}, errs) {
+		t.Fatal("The write errors weren't attributed to the orders")
+	}
+	if errs[0] == nil || errs[1] != nil || errs[2] == nil {
+		t.Errorf("The write errors were attributed as %v", errs)
+	}
+	// Only the throttled order is sent again by CreateMany
+	if _, isThrottled := throttleRetryAfter(errs[2]); !isThrottled {
+		t.Errorf("The throttled order's error %v isn't recognized as throttled", errs[2])
+	}
+	if _, isThrottled := throttleRetryAfter(errs[0]); isThrottled {
+		t.Errorf("The duplicate order's error %v is recognized as throttled", errs[0])
+	}
+
+	for _, err := range []error{
+		errors.New("connection reset"),
+		mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{WriteError: mongo.WriteError{Index: 3}}}},
+		mongo.BulkWriteException{WriteConcernError: &mongo.WriteConcernError{Code: 64}, WriteErrors: []mongo.BulkWriteError{duplicate}},
+	} {
+		if attributeBulkErrors(err, make([]error, 3)) {
+			t.Errorf("%v was attributed to the orders", err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Types of the CloudEvents published about orders. Don't rename them, consumers subscribe to them.
+const (
+	OrderCreatedEventType   = "com.microsoft.captureorder.order.created"
+	OrderCancelledEventType = "com.microsoft.captureorder.order.cancelled"
+)
+
+// orderEventDataSchema identifies the version of the order carried as the data of order events.
+// Bump it when the JSON of Order changes in a way consumers would notice.
+const orderEventDataSchema = "urn:captureorder:schema:order:v1"
+
+// Content types of CloudEvents in structured mode and of their data
+const (
+	cloudEventsContentType = "application/cloudevents+json; charset=utf-8"
+	jsonContentType        = "application/json"
+)
+
+// How CloudEvents are put on the wire: "structured" sends the whole event as JSON, "binary" sends
+// the data as the message body and the other attributes as message properties or headers.
+// Override with the CLOUDEVENTS_MODE environment variable.
+var cloudEventsMode = getEnv("CLOUDEVENTS_MODE", "structured")
+
+// CloudEvent is a CloudEvents 1.0 event, in its JSON format
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	Type            string          `json:"type"`
+	Source          string          `json:"source"`
+	ID              string          `json:"id"`
+	Time            time.Time       `json:"time"`
+	Subject         string          `json:"subject,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	DataSchema      string          `json:"dataschema,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+
+	// CorrelationID is an extension attribute with the correlation ID of the request that caused the event
+	CorrelationID string `json:"correlationid,omitempty"`
+}
+
+// binaryMode reports whether events are sent in binary rather than structured mode
+func binaryMode() bool {
+	return cloudEventsMode == "binary"
+}
+
+// newOrderEvent returns an event of the given type carrying the order. The ID identifies
+// the event, so redeliveries of the same event can be recognized by consumers.
+func newOrderEvent(eventType string, id primitive.ObjectID, order Order, at time.Time) CloudEvent {
+	data, _ := json.Marshal(order)
+	return CloudEvent{
+		SpecVersion:     "1.0",
+		Type:            eventType,
+		Source:          orderEventSource(),
+		ID:              id.Hex(),
+		Time:            at.UTC(),
+		Subject:         order.ID.Hex(),
+		DataContentType: jsonContentType,
+		DataSchema:      orderEventDataSchema,
+		Data:            data,
+		CorrelationID:   order.CorrelationID,
+	}
+}
+
+// orderEventSource identifies this service, and the team running it if TEAMNAME is set
+func orderEventSource() string {
+	if teamName == "" {
+		return "/captureorder"
+	}
+	return "/captureorder/teams/" + url.PathEscape(teamName)
+}
+
+// decodeOutboxEvent returns the event stored in an outbox message. Messages stored before
+// events were introduced only hold the order ID, they are sent as created events carrying that body.
+func decodeOutboxEvent(message OutboxMessage) CloudEvent {
+	var event CloudEvent
+	if err := json.Unmarshal([]byte(message.Body), &event); err == nil && event.SpecVersion != "" {
+		return event
+	}
+	return CloudEvent{
+		SpecVersion:     "1.0",
+		Type:            OrderCreatedEventType,
+		Source:          orderEventSource(),
+		ID:              message.ID.Hex(),
+		Time:            message.CreatedAt.UTC(),
+		Subject:         message.OrderID,
+		DataContentType: jsonContentType,
+		Data:            json.RawMessage(message.Body),
+	}
+}
+
+// cloudEventAttributes returns the attributes of an event other than its data,
+// by name, as sent in binary mode. Empty optional attributes are left out.
+func cloudEventAttributes(event CloudEvent) map[string]interface{} {
+	attributes := map[string]interface{}{
+		"specversion": event.SpecVersion,
+		"type":        event.Type,
+		"source":      event.Source,
+		"id":          event.ID,
+		"time":        event.Time,
+	}
+	if event.Subject != "" {
+		attributes["subject"] = event.Subject
+	}
+	if event.DataSchema != "" {
+		attributes["dataschema"] = event.DataSchema
+	}
+	if event.CorrelationID != "" {
+		attributes["correlationid"] = event.CorrelationID
+	}
+	return attributes
+}
+
+// initCloudEventsMode reads how events are put on the wire
+func initCloudEventsMode() {
+	if cloudEventsMode != "structured" && cloudEventsMode != "binary" {
+		printErr("Ignoring invalid CLOUDEVENTS_MODE: ", cloudEventsMode)
+		cloudEventsMode = "structured"
+	}
+	log.Printf("Order events are sent as %s CloudEvents. You can override by setting the CLOUDEVENTS_MODE environment variable.", cloudEventsMode)
+}
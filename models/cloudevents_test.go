@@ -0,0 +1,91 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNewOrderEvent(t *testing.T) {
+	order := newTestOrder("jane@example.com", "sku-1")
+	prepareNewOrder(&order)
+	id := primitive.NewObjectID()
+
+	event := newOrderEvent(OrderCreatedEventType, id, order, order.CreatedAt)
+	body, _ := json.Marshal(event)
+
+	var decoded map[string]interface{}
+	json.Unmarshal(body, &decoded)
+	for _, attribute := range []string{"specversion", "type", "source", "id", "time", "subject", "datacontenttype", "dataschema", "data"} {
+		if _, ok := decoded[attribute]; !ok {
+			t.Errorf("The event has no %s: %s", attribute, body)
+		}
+	}
+	if decoded["specversion"] != "1.0" || decoded["id"] != id.Hex() || decoded["subject"] != order.ID.Hex() {
+		t.Errorf("The event is %s", body)
+	}
+	if _, ok := decoded["correlationid"]; ok {
+		t.Errorf("The event has a correlation ID without a request: %s", body)
+	}
+
+	var data Order
+	if err := json.Unmarshal(event.Data, &data); err != nil || data.ID != order.ID || data.EmailAddress != order.EmailAddress || len(data.Items) != 1 {
+		t.Errorf("The event carries %+v, expected the whole order", data)
+	}
+}
+
+func TestDecodeOutboxEvent(t *testing.T) {
+	order := newTestOrder("jane@example.com", "sku-1")
+	prepareNewOrder(&order)
+	order.CorrelationID = "request-1"
+	message := newOrderAddedOutboxMessage(order)
+
+	event := decodeOutboxEvent(message)
+	if event.ID != message.ID.Hex() || event.Subject != order.ID.Hex() || event.Type != OrderCreatedEventType || event.CorrelationID != "request-1" {
+		t.Errorf("decodeOutboxEvent returned %+v", event)
+	}
+
+	// Messages stored before events only hold the order ID
+	legacy := OutboxMessage{ID: primitive.NewObjectID(), OrderID: order.ID.Hex(), Body: `{"order": "` + order.ID.Hex() + `", "source": "team"}`, CreatedAt: time.Now()}
+	event = decodeOutboxEvent(legacy)
+	if event.ID != legacy.ID.Hex() || event.Subject != order.ID.Hex() || string(event.Data) != legacy.Body {
+		t.Errorf("decodeOutboxEvent of a legacy message returned %+v", event)
+	}
+}
+
+func TestCloudEventBindings(t *testing.T) {
+	defer func(mode string) { cloudEventsMode = mode }(cloudEventsMode)
+	order := newTestOrder("jane@example.com", "sku-1")
+	prepareNewOrder(&order)
+	event := newOrderEvent(OrderCreatedEventType, primitive.NewObjectID(), order, order.CreatedAt)
+
+	cloudEventsMode = "structured"
+	message := amqpMessage(event)
+	if message.Properties.ContentType != cloudEventsContentType || message.Properties.MessageID != order.ID.Hex() || message.ApplicationProperties["cloudEvents_type"] != nil {
+		t.Errorf("The structured AMQP message is %+v", message)
+	}
+	record := kafkaMessage("orders", event)
+	if key, _ := record.Key.Encode(); string(key) != order.ID.Hex() || len(record.Headers) != 1 {
+		t.Errorf("The structured Kafka message has the key %s and headers %v", key, record.Headers)
+	}
+
+	cloudEventsMode = "binary"
+	message = amqpMessage(event)
+	if message.Properties.ContentType != jsonContentType || message.ApplicationProperties["cloudEvents_type"] != OrderCreatedEventType ||
+		message.ApplicationProperties["cloudEvents_subject"] != order.ID.Hex() {
+		t.Errorf("The binary AMQP message has the properties %v", message.ApplicationProperties)
+	}
+	record = kafkaMessage("orders", event)
+	headers := map[string]string{}
+	for _, header := range record.Headers {
+		headers[string(header.Key)] = string(header.Value)
+	}
+	if headers["content-type"] != jsonContentType || headers["ce_id"] != event.ID || headers["ce_time"] != event.Time.Format(time.RFC3339Nano) {
+		t.Errorf("The binary Kafka message has the headers %v", headers)
+	}
+	if value, _ := record.Value.Encode(); string(value) != string(event.Data) {
+		t.Errorf("The binary Kafka message carries %s, expected the order", value)
+	}
+}
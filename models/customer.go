@@ -0,0 +1,157 @@
+package models
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Page size limits for GetCustomerOrderHistory
+const (
+	DefaultCustomerOrderLimit = 50
+	MaxCustomerOrderLimit     = 200
+)
+
+// CustomerOrderHistory summarizes the orders of one customer
+type CustomerOrderHistory struct {
+	EmailAddress  string  `json:"emailAddress"`
+	OrderCount    int     `json:"orderCount"`
+	LifetimeValue float64 `json:"lifetimeValue"` // total of every order that wasn't cancelled or failed
+	Orders        []Order `json:"orders"`        // newest first, at most the requested limit
+}
+
+// NormalizeEmailAddress returns the form of an email address used to look up a customer's orders
+func NormalizeEmailAddress(emailAddress string) string {
+	return strings.ToLower(strings.TrimSpace(emailAddress))
+}
+
+// GetCustomerOrderHistory returns the newest orders of the customer with the given email address,
+// matched case-insensitively, along with the count and lifetime value of all their orders.
+func GetCustomerOrderHistory(store OrderStore, emailAddress string, limit int) (CustomerOrderHistory, error) {
+	normalized := NormalizeEmailAddress(emailAddress)
+
+	if normalized == "" {
+		return CustomerOrderHistory{EmailAddress: normalized, Orders: []Order{}}, &ValidationError{[]FieldError{{"emailAddress", FieldErrorRequired, "is required"}}}
+	}
+	if !isValidEmailAddress(normalized) {
+		return CustomerOrderHistory{EmailAddress: normalized, Orders: []Order{}}, &ValidationError{[]FieldError{{"emailAddress", FieldErrorInvalid, "is not a valid email address"}}}
+	}
+
+	if limit <= 0 {
+		limit = DefaultCustomerOrderLimit
+	} else if limit > MaxCustomerOrderLimit {
+		limit = MaxCustomerOrderLimit
+	}
+
+	return store.CustomerOrders(normalized, limit)
+}
+
+// CustomerOrders returns the customer order history for a normalized email address from MongoDB/CosmosDB
+func (s *MongoOrderStore) CustomerOrders(normalized string, limit int) (CustomerOrderHistory, error) {
+	history := CustomerOrderHistory{EmailAddress: normalized, Orders: []Order{}}
+
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	log.Println("Querying MongoDB URL: ", mongoHost, " CosmosDB: ", isCosmosDb)
+
+	mongoDBCollection := s.orders()
+	query := bson.M{"emailAddressNormalized": normalized}
+
+	err := retryThrottled(ctx, "query customer orders", func() error {
+		cursor, err := mongoDBCollection.Find(ctx, query, options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(int64(limit)))
+		if err == nil {
+			err = cursor.All(ctx, &history.Orders)
+		}
+		return err
+	})
+	if err != nil {
+		printErr("Problem querying customer orders: ", err)
+		return history, err
+	}
+
+	var orderCount int64
+	err = retryThrottled(ctx, "count customer orders", func() error {
+		var err error
+		orderCount, err = mongoDBCollection.CountDocuments(ctx, query)
+		return err
+	})
+	if err != nil {
+		printErr("Problem counting customer orders: ", err)
+		return history, err
+	}
+	history.OrderCount = int(orderCount)
+
+	var lifetimeValue []struct {
+		Total float64 `bson:"total"`
+	}
+	err = retryThrottled(ctx, "sum customer lifetime value", func() error {
+		cursor, err := mongoDBCollection.Aggregate(ctx, []bson.M{
+			{"$match": bson.M{"emailAddressNormalized": normalized, "status": bson.M{"$nin": []string{StatusCancelled, StatusFailed}}}},
+			{"$group": bson.M{"_id": nil, "total": bson.M{"$sum": "$total"}}},
+		})
+		if err == nil {
+			err = cursor.All(ctx, &lifetimeValue)
+		}
+		return err
+	})
+	if err != nil {
+		printErr("Problem summing customer lifetime value: ", err)
+		return history, err
+	}
+	if len(lifetimeValue) > 0 {
+		history.LifetimeValue = roundToCents(lifetimeValue[0].Total)
+	}
+
+	log.Println("Customer order count:", history.OrderCount)
+	return history, nil
+}
+
+// initNormalizedEmailBackfill starts the backfill if asked to. The emailAddressNormalized index is in orderIndexes.
+func (s *MongoOrderStore) initNormalizedEmailBackfill() {
+	// Orders stored before the normalized email address existed are only found once backfilled
+	if os.Getenv("BACKFILL_NORMALIZED_EMAILS") == "true" {
+		go s.backfillNormalizedEmailAddresses()
+	}
+}
+
+// backfillNormalizedEmailAddresses sets emailAddressNormalized on orders stored without it
+func (s *MongoOrderStore) backfillNormalizedEmailAddresses() {
+	// The backfill scans the whole collection, so it isn't bound by mongoTimeout
+	ctx := context.Background()
+
+	log.Println("Backfilling emailAddressNormalized on existing orders")
+
+	mongoDBCollection := s.orders()
+	cursor, err := mongoDBCollection.Find(ctx, bson.M{"emailAddressNormalized": bson.M{"$exists": false}},
+		options.Find().SetProjection(bson.M{"emailAddress": 1}))
+	if err != nil {
+		printErr("Problem backfilling emailAddressNormalized: ", err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	updated := 0
+	for cursor.Next(ctx) {
+		var order Order
+		if err := cursor.Decode(&order); err != nil {
+			printErr("Problem backfilling emailAddressNormalized: ", err)
+			continue
+		}
+		_, err := mongoDBCollection.UpdateByID(ctx, order.ID, bson.M{"$set": bson.M{"emailAddressNormalized": NormalizeEmailAddress(order.EmailAddress)}})
+		if err != nil {
+			printErr("Problem backfilling emailAddressNormalized: ", err)
+			continue
+		}
+		updated++
+	}
+	if err := cursor.Err(); err != nil {
+		printErr("Problem backfilling emailAddressNormalized: ", err)
+	}
+
+	log.Println("Backfilled emailAddressNormalized on orders:", updated)
+}
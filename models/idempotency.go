@@ -0,0 +1,229 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IdempotencyRecord remembers the outcome of a request sent with an Idempotency-Key
+// so that retries of the same request get the same response instead of a new order.
+type IdempotencyRecord struct {
+	Key         string    `bson:"_id"`
+	RequestHash string    `bson:"requestHash"`
+	OrderID     string    `bson:"orderId,omitempty"`
+	StatusCode  int       `bson:"statusCode"` // 0 while the original request is still being processed
+	Response    []byte    `bson:"response,omitempty"`
+	CreatedAt   time.Time `bson:"createdAt"`
+	Reservation string    `bson:"reservation,omitempty"` // identifies the request holding the key
+}
+
+// Pending reports whether the original request is still being processed
+func (r *IdempotencyRecord) Pending() bool {
+	return r.StatusCode == 0
+}
+
+// expired reports whether the key can be reserved again, because it is older than the idempotency
+// window or because its request didn't complete within idempotencyPendingLease
+func (r *IdempotencyRecord) expired() bool {
+	age := time.Since(r.CreatedAt)
+	return age > idempotencyWindow || (r.Pending() && age > idempotencyPendingLease)
+}
+
+// MaxIdempotencyKeyLength is the longest Idempotency-Key accepted
+const MaxIdempotencyKeyLength = 255
+
+// ErrIdempotencyKeyTooLong is returned for keys longer than MaxIdempotencyKeyLength
+var ErrIdempotencyKeyTooLong = errors.New("idempotency key is too long")
+
+// ErrIdempotencyReservationLost is returned when a request completes or releases a key
+// that another request took over after its reservation expired
+var ErrIdempotencyReservationLost = errors.New("idempotency key was reserved by another request")
+
+var idempotencyCollectionName = "idempotency"
+
+// How long a key is remembered. Override with the IDEMPOTENCY_WINDOW environment variable, e.g. 1h30m
+var idempotencyWindow = 24 * time.Hour
+
+// How long a key stays reserved by a request that hasn't completed. A request that crashed or couldn't
+// store its response leaves its key pending, and retries are refused until then. Longer than a request can take.
+var idempotencyPendingLease = 2 * time.Minute
+
+// HashRequest fingerprints a request body so reuse of a key with a different payload can be detected
+func HashRequest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// newIdempotencyReservation returns a token identifying one reservation of a key
+func newIdempotencyReservation() string {
+	return primitive.NewObjectID().Hex()
+}
+
+// BeginIdempotentRequest reserves key for a request with the given hash.
+// If the key was already used within the idempotency window the existing record is returned
+// and the caller must not process the request again. Otherwise it returns nil and a reservation,
+// and the caller must finish with CompleteIdempotentRequest or ReleaseIdempotentRequest.
+func (s *MongoOrderStore) BeginIdempotentRequest(key string, requestHash string) (*IdempotencyRecord, string, error) {
+	if len(key) > MaxIdempotencyKeyLength {
+		return nil, "", ErrIdempotencyKeyTooLong
+	}
+
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	mongoDBCollection := s.idempotencyRecords()
+
+	record := IdempotencyRecord{Key: key, RequestHash: requestHash, CreatedAt: time.Now().UTC(), Reservation: newIdempotencyReservation()}
+	err := retryThrottled(ctx, "reserve idempotency key", func() error {
+		_, err := mongoDBCollection.InsertOne(ctx, record)
+		return err
+	})
+	if err == nil {
+		return nil, record.Reservation, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		printErr("Problem reserving idempotency key: ", err)
+		return nil, "", err
+	}
+
+	var existing IdempotencyRecord
+	err = retryThrottled(ctx, "read idempotency key", func() error {
+		return mongoDBCollection.FindOne(ctx, bson.M{"_id": key}).Decode(&existing)
+	})
+	if err == mongo.ErrNoDocuments {
+		// Released between our insert and find, let the caller go ahead
+		if _, err = mongoDBCollection.InsertOne(ctx, record); err != nil {
+			return nil, "", err
+		}
+		return nil, record.Reservation, nil
+	}
+	if err != nil {
+		printErr("Problem reading idempotency key: ", err)
+		return nil, "", err
+	}
+
+	if existing.expired() {
+		// The key expired but hasn't been cleaned up yet, so take it over unless another request
+		// took it over or completed it since it was read
+		var result *mongo.UpdateResult
+		err = retryThrottled(ctx, "replace expired idempotency key", func() error {
+			var err error
+			result, err = mongoDBCollection.ReplaceOne(ctx, bson.M{"_id": key, "createdAt": existing.CreatedAt, "statusCode": existing.StatusCode}, record)
+			return err
+		})
+		if err != nil {
+			printErr("Problem replacing expired idempotency key: ", err)
+			return nil, "", err
+		}
+		if result.MatchedCount == 1 {
+			return nil, record.Reservation, nil
+		}
+
+		// Another request got there first, answer with its record
+		err = retryThrottled(ctx, "read idempotency key", func() error {
+			return mongoDBCollection.FindOne(ctx, bson.M{"_id": key}).Decode(&existing)
+		})
+		if err == mongo.ErrNoDocuments {
+			if _, err = mongoDBCollection.InsertOne(ctx, record); err != nil {
+				return nil, "", err
+			}
+			return nil, record.Reservation, nil
+		}
+		if err != nil {
+			printErr("Problem reading idempotency key: ", err)
+			return nil, "", err
+		}
+	}
+
+	return &existing, "", nil
+}
+
+// CompleteIdempotentRequest stores the response of a request reserved with BeginIdempotentRequest,
+// unless another request took the key over since
+func (s *MongoOrderStore) CompleteIdempotentRequest(key string, reservation string, orderID string, statusCode int, response []byte) error {
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	var result *mongo.UpdateResult
+	err := retryThrottled(ctx, "store idempotent response", func() error {
+		var err error
+		result, err = s.idempotencyRecords().UpdateOne(ctx, bson.M{"_id": key, "reservation": reservation, "statusCode": 0}, bson.M{"$set": bson.M{
+			"orderId":    orderID,
+			"statusCode": statusCode,
+			"response":   response,
+		}})
+		return err
+	})
+	if err != nil {
+		printErr("Problem storing idempotent response: ", err)
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrIdempotencyReservationLost
+	}
+	return nil
+}
+
+// ReleaseIdempotentRequest forgets a key reserved with BeginIdempotentRequest
+// so that a request which failed can be retried with the same key.
+func (s *MongoOrderStore) ReleaseIdempotentRequest(key string, reservation string) error {
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	var result *mongo.DeleteResult
+	err := retryThrottled(ctx, "release idempotency key", func() error {
+		var err error
+		result, err = s.idempotencyRecords().DeleteOne(ctx, bson.M{"_id": key, "reservation": reservation, "statusCode": 0})
+		return err
+	})
+	if err != nil {
+		printErr("Problem releasing idempotency key: ", err)
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrIdempotencyReservationLost
+	}
+	return nil
+}
+
+// initIdempotencyWindow reads how long idempotency keys are remembered
+func initIdempotencyWindow() {
+	if window := os.Getenv("IDEMPOTENCY_WINDOW"); window != "" {
+		if d, err := time.ParseDuration(window); err == nil && d > 0 {
+			idempotencyWindow = d
+		} else {
+			printErr("Ignoring invalid IDEMPOTENCY_WINDOW: ", window)
+		}
+	}
+	log.Printf("Idempotency window set to %v. You can override by setting the IDEMPOTENCY_WINDOW environment variable.", idempotencyWindow)
+}
+
+// initIdempotency lets MongoDB expire old idempotency keys
+func (s *MongoOrderStore) initIdempotency() {
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	// Expired keys are also ignored when read, so the TTL index is only housekeeping
+	_, err := s.idempotencyRecords().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "createdAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(idempotencyWindow.Seconds())),
+	})
+	if err != nil {
+		trackException(err)
+		printErr("Could not create the TTL index on the idempotency collection. Expired keys won't be cleaned up: ", err)
+	}
+}
+
+// idempotencyRecords returns the idempotency collection
+func (s *MongoOrderStore) idempotencyRecords() *mongo.Collection {
+	return s.mongoDBClient.Database(mongoDatabaseName).Collection(idempotencyCollectionName)
+}
@@ -0,0 +1,206 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// indexSpec declares a secondary index. Its name is the one MongoDB generates for the keys,
+// so indexes created before they were managed here are recognized.
+type indexSpec struct {
+	Name string
+	Keys bson.D
+}
+
+// newIndexSpec declares an index on keys, given as field and direction pairs
+func newIndexSpec(keys ...bson.E) indexSpec {
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = fmt.Sprintf("%s_%v", key.Key, key.Value)
+	}
+	return indexSpec{Name: strings.Join(parts, "_"), Keys: bson.D(keys)}
+}
+
+// orderIndexes are the secondary indexes of the orders collection. Every query on it other than
+// by _id should be served by one of them, a full scan costs a lot of RUs on CosmosDB.
+// Lists sort on _id, so the list filters are compound with it.
+var orderIndexes = []indexSpec{
+	newIndexSpec(bson.E{Key: "status", Value: 1}, bson.E{Key: "_id", Value: -1}),
+	newIndexSpec(bson.E{Key: "emailAddress", Value: 1}, bson.E{Key: "_id", Value: -1}),
+	newIndexSpec(bson.E{Key: "items.sku", Value: 1}, bson.E{Key: "_id", Value: -1}),
+	newIndexSpec(bson.E{Key: "product", Value: 1}, bson.E{Key: "_id", Value: -1}), // legacy single product orders
+	newIndexSpec(bson.E{Key: "createdAt", Value: 1}),
+	newIndexSpec(bson.E{Key: "emailAddressNormalized", Value: 1}), // customer order history
+	newIndexSpec(bson.E{Key: "outbox.nextAttemptAt", Value: 1}),   // outbox relay
+}
+
+// existingIndex is an index as listed by MongoDB
+type existingIndex struct {
+	Name string `bson:"name"`
+	Key  bson.D `bson:"key"`
+}
+
+// IndexDrift describes how the indexes of a collection differ from the declared ones
+type IndexDrift struct {
+	Missing   []string // declared but not in the collection
+	Changed   []string // in the collection under a declared name but with other keys
+	Unmanaged []string // in the collection but not declared
+}
+
+// InSync reports whether the collection has exactly the declared indexes
+func (d IndexDrift) InSync() bool {
+	return len(d.Missing) == 0 && len(d.Changed) == 0 && len(d.Unmanaged) == 0
+}
+
+// Whether NewMongoOrderStore creates missing indexes. Set ENSURE_INDEXES=false when they are
+// created by running "captureorderfd migrate" as a separate deployment step instead.
+var ensureIndexesAtStartup = os.Getenv("ENSURE_INDEXES") != "false"
+
+// EnsureOrderIndexes creates the declared indexes missing from the orders collection and logs
+// any other drift. Changed and unmanaged indexes are left alone, dropping them is up to an operator.
+// It is safe to run on every startup, indexes that already exist aren't touched.
+func (s *MongoOrderStore) EnsureOrderIndexes() (IndexDrift, error) {
+	drift, err := s.CheckOrderIndexes()
+	if err != nil || len(drift.Missing) == 0 {
+		return drift, err
+	}
+
+	var missing []mongo.IndexModel
+	for _, spec := range orderIndexes {
+		for _, name := range drift.Missing {
+			if spec.Name == name {
+				missing = append(missing, mongo.IndexModel{Keys: spec.Keys, Options: options.Index().SetName(spec.Name)})
+			}
+		}
+	}
+
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	log.Println("Creating order indexes:", strings.Join(drift.Missing, ", "))
+	if _, err := s.orders().Indexes().CreateMany(ctx, missing); err != nil {
+		trackException(err)
+		printErr("Problem creating order indexes: ", err)
+		return drift, err
+	}
+	drift.Missing = nil
+	return drift, nil
+}
+
+// CheckOrderIndexes compares the indexes of the orders collection with the declared ones and logs any drift
+func (s *MongoOrderStore) CheckOrderIndexes() (IndexDrift, error) {
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	var existing []existingIndex
+	cursor, err := s.orders().Indexes().List(ctx)
+	if err == nil {
+		err = cursor.All(ctx, &existing)
+	}
+	if err != nil {
+		printErr("Problem listing order indexes: ", err)
+		return IndexDrift{}, err
+	}
+
+	drift := indexDrift(orderIndexes, existing)
+	if len(drift.Missing) > 0 {
+		log.Println("Order indexes missing:", strings.Join(drift.Missing, ", "))
+	}
+	if len(drift.Changed) > 0 {
+		printErr("Order indexes with other keys than declared, drop them to have them recreated: ", strings.Join(drift.Changed, ", "))
+	}
+	if len(drift.Unmanaged) > 0 {
+		log.Println("Order indexes not declared in orderIndexes:", strings.Join(drift.Unmanaged, ", "))
+	}
+	if drift.InSync() {
+		log.Println("Order indexes are in sync")
+	}
+	return drift, nil
+}
+
+// MigrateOrderStore brings the schema of the store picked by ORDERSTORE up to date, see "captureorderfd migrate".
+// For MongoDB/CosmosDB that shards the orders collection and creates the declared indexes,
+// for SQL databases it applies the schema migrations.
+func MigrateOrderStore() error {
+	switch orderStoreBackend {
+	case "", "mongo":
+		ensureIndexesAtStartup = true
+	case "memory":
+		log.Println("The in-memory order store has nothing to migrate")
+		return nil
+	}
+	_, _, _, err := NewOrderStore()
+	return err
+}
+
+// initOrderIndexes creates or only checks the order indexes, depending on ENSURE_INDEXES
+func (s *MongoOrderStore) initOrderIndexes() {
+	var err error
+	if ensureIndexesAtStartup {
+		_, err = s.EnsureOrderIndexes()
+	} else {
+		_, err = s.CheckOrderIndexes()
+	}
+	if err != nil {
+		printErr("Could not manage the order indexes. Queries on orders may scan the collection: ", err)
+	}
+}
+
+// indexDrift compares the declared indexes with those listed by MongoDB.
+// The _id index always exists and isn't reported.
+func indexDrift(declared []indexSpec, existing []existingIndex) IndexDrift {
+	var drift IndexDrift
+
+	existingKeys := map[string]string{}
+	for _, index := range existing {
+		if index.Name != "_id_" {
+			existingKeys[index.Name] = indexKeysString(index.Key)
+		}
+	}
+
+	declaredNames := map[string]bool{}
+	for _, spec := range declared {
+		declaredNames[spec.Name] = true
+		keys, ok := existingKeys[spec.Name]
+		switch {
+		case !ok:
+			drift.Missing = append(drift.Missing, spec.Name)
+		case keys != indexKeysString(spec.Keys):
+			drift.Changed = append(drift.Changed, spec.Name)
+		}
+	}
+
+	for _, index := range existing {
+		if index.Name != "_id_" && !declaredNames[index.Name] {
+			drift.Unmanaged = append(drift.Unmanaged, index.Name)
+		}
+	}
+	return drift
+}
+
+// indexKeysString renders index keys for comparison. MongoDB returns the directions
+// as int32 or float64 depending on the server, so numbers are compared by value.
+func indexKeysString(keys bson.D) string {
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		switch v := key.Value.(type) {
+		case int:
+			parts[i] = fmt.Sprintf("%s:%d", key.Key, v)
+		case int32:
+			parts[i] = fmt.Sprintf("%s:%d", key.Key, v)
+		case int64:
+			parts[i] = fmt.Sprintf("%s:%d", key.Key, v)
+		case float64:
+			parts[i] = fmt.Sprintf("%s:%d", key.Key, int(v))
+		default:
+			parts[i] = fmt.Sprintf("%s:%v", key.Key, v)
+		}
+	}
+	return strings.Join(parts, ",")
+}
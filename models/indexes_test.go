@@ -0,0 +1,47 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestNewIndexSpecName(t *testing.T) {
+	spec := newIndexSpec(bson.E{Key: "status", Value: 1}, bson.E{Key: "_id", Value: -1})
+	if spec.Name != "status_1__id_-1" {
+		t.Errorf("newIndexSpec named the index %s, expected MongoDB's default status_1__id_-1", spec.Name)
+	}
+}
+
+func TestIndexDrift(t *testing.T) {
+	declared := []indexSpec{
+		newIndexSpec(bson.E{Key: "status", Value: 1}, bson.E{Key: "_id", Value: -1}),
+		newIndexSpec(bson.E{Key: "createdAt", Value: 1}),
+		newIndexSpec(bson.E{Key: "emailAddress", Value: 1}, bson.E{Key: "_id", Value: -1}),
+	}
+	existing := []existingIndex{
+		{Name: "_id_", Key: bson.D{{Key: "_id", Value: int32(1)}}},
+		// Servers return the directions as int32 or float64
+		{Name: "status_1__id_-1", Key: bson.D{{Key: "status", Value: int32(1)}, {Key: "_id", Value: float64(-1)}}},
+		{Name: "emailAddress_1__id_-1", Key: bson.D{{Key: "emailAddress", Value: int32(1)}}},
+		{Name: "legacy", Key: bson.D{{Key: "product", Value: int32(1)}}},
+	}
+
+	drift := indexDrift(declared, existing)
+	expected := IndexDrift{
+		Missing:   []string{"createdAt_1"},
+		Changed:   []string{"emailAddress_1__id_-1"},
+		Unmanaged: []string{"legacy"},
+	}
+	if !reflect.DeepEqual(drift, expected) {
+		t.Errorf("indexDrift returned %+v, expected %+v", drift, expected)
+	}
+	if drift.InSync() {
+		t.Error("A drifted collection was reported in sync")
+	}
+
+	if drift := indexDrift(declared[:1], existing[:2]); !drift.InSync() {
+		t.Errorf("Matching indexes were reported as drifted: %+v", drift)
+	}
+}
@@ -0,0 +1,117 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// Kafka settings. Override with the KAFKA_BROKERS, KAFKA_TOPIC, KAFKA_ACKS and KAFKA_IDEMPOTENT environment variables.
+var (
+	kafkaBrokers    = os.Getenv("KAFKA_BROKERS") // comma separated host:port list
+	kafkaTopic      = getEnv("KAFKA_TOPIC", "orders")
+	kafkaAcks       = getEnv("KAFKA_ACKS", "all")
+	kafkaIdempotent = os.Getenv("KAFKA_IDEMPOTENT") != "false"
+)
+
+// KafkaPublisher sends messages to a Kafka topic, keyed by order ID so the messages
+// of an order land on the same partition and are consumed in order.
+type KafkaPublisher struct {
+	producer sarama.SyncProducer
+	topic    string
+}
+
+// NewKafkaPublisher connects to the Kafka brokers set by the KAFKA_* environment variables
+func NewKafkaPublisher() (*KafkaPublisher, error) {
+	if kafkaBrokers == "" {
+		return nil, fmt.Errorf("ORDERPUBLISHER=kafka needs the KAFKA_BROKERS environment variable")
+	}
+	config, err := kafkaProducerConfig(kafkaAcks, kafkaIdempotent)
+	if err != nil {
+		return nil, err
+	}
+
+	brokers := strings.Split(kafkaBrokers, ",")
+	producer, err := sarama.NewSyncProducer(brokers, config)
+	if err != nil {
+		trackException(err)
+		return nil, fmt.Errorf("couldn't connect to Kafka at %s: %v", kafkaBrokers, err)
+	}
+
+	log.Printf("Publishing order messages to the Kafka topic %s at %s (acks: %s, idempotent: %t). You can override by setting the KAFKA_TOPIC, KAFKA_ACKS and KAFKA_IDEMPOTENT environment variables.",
+		kafkaTopic, kafkaBrokers, kafkaAcks, kafkaIdempotent)
+	return &KafkaPublisher{producer: producer, topic: kafkaTopic}, nil
+}
+
+// kafkaProducerConfig builds the producer settings for acks (all, leader or none) and idempotence
+func kafkaProducerConfig(acks string, idempotent bool) (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.ClientID = "captureorder"
+	config.Producer.Return.Successes = true // needed by the sync producer
+
+	switch acks {
+	case "all":
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	case "leader":
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	case "none":
+		config.Producer.RequiredAcks = sarama.NoResponse
+	default:
+		return nil, fmt.Errorf("unknown KAFKA_ACKS %q, use all, leader or none", acks)
+	}
+
+	if idempotent {
+		// The broker drops the duplicates of retried sends, which needs every replica to acknowledge
+		// and a single request in flight so they can't be reordered
+		if acks != "all" {
+			return nil, fmt.Errorf("KAFKA_IDEMPOTENT needs KAFKA_ACKS=all, set KAFKA_IDEMPOTENT=false to use %s", acks)
+		}
+		config.Producer.Idempotent = true
+		config.Net.MaxOpenRequests = 1
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Publish sends the event to the topic with the order ID as its key
+func (p *KafkaPublisher) Publish(event CloudEvent) bool {
+	partition, offset, err := p.producer.SendMessage(kafkaMessage(p.topic, event))
+	if err != nil {
+		printErr("Encountered an error sending to Kafka: ", err)
+		trackException(err)
+		return false
+	}
+
+	log.Printf("Sent to Kafka - %s[%d]@%d: %s event %s for order %s", p.topic, partition, offset, event.Type, event.ID, event.Subject)
+	return true
+}
+
+// kafkaMessage puts an event in a Kafka message following the CloudEvents Kafka binding,
+// in the mode set by CLOUDEVENTS_MODE
+func kafkaMessage(topic string, event CloudEvent) *sarama.ProducerMessage {
+	message := &sarama.ProducerMessage{Topic: topic, Key: sarama.StringEncoder(event.Subject)}
+	if !binaryMode() {
+		body, _ := json.Marshal(event)
+		message.Value = sarama.ByteEncoder(body)
+		message.Headers = []sarama.RecordHeader{{Key: []byte("content-type"), Value: []byte(cloudEventsContentType)}}
+		return message
+	}
+
+	message.Value = sarama.ByteEncoder(event.Data)
+	message.Headers = []sarama.RecordHeader{{Key: []byte("content-type"), Value: []byte(event.DataContentType)}}
+	for name, value := range cloudEventAttributes(event) {
+		if t, ok := value.(time.Time); ok {
+			value = t.Format(time.RFC3339Nano)
+		}
+		message.Headers = append(message.Headers, sarama.RecordHeader{Key: []byte("ce_" + name), Value: []byte(value.(string))})
+	}
+	return message
+}
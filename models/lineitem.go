@@ -0,0 +1,41 @@
+package models
+
+import "math"
+
+// MaxLineItems is the most line items accepted on a single order
+const MaxLineItems = 100
+
+// LineItem is a single product line of an order
+type LineItem struct {
+	SKU       string  `json:"sku" bson:"sku"`
+	Quantity  int     `json:"quantity" bson:"quantity"`
+	UnitPrice float64 `json:"unitPrice" bson:"unitPrice"`
+	LineTotal float64 `json:"lineTotal" bson:"lineTotal"`
+}
+
+// PriceOrder fills in the server computed amounts of an order. Legacy orders that only carry
+// a Product and Total are first mapped to a single line item of that product.
+func PriceOrder(order *Order) {
+	if len(order.Items) == 0 && order.Product != "" {
+		order.Items = []LineItem{{SKU: order.Product, Quantity: 1, UnitPrice: order.Total}}
+	}
+
+	order.Subtotal = 0
+	for i := range order.Items {
+		item := &order.Items[i]
+		item.LineTotal = roundToCents(float64(item.Quantity) * item.UnitPrice)
+		order.Subtotal += item.LineTotal
+	}
+	order.Subtotal = roundToCents(order.Subtotal)
+
+	// No taxes, shipping or discounts yet
+	order.Total = order.Subtotal
+}
+
+// roundToCents rounds an amount half away from zero to two decimals
+func roundToCents(amount float64) float64 {
+	if amount < 0 {
+		return -roundToCents(-amount)
+	}
+	return math.Floor(amount*100+0.5) / 100
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPriceOrder(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		order    Order
+		items    []LineItem
+		subtotal float64
+	}{
+		{
+			"legacy order",
+			Order{Product: "sku-1", Total: 10.5},
+			[]LineItem{{SKU: "sku-1", Quantity: 1, UnitPrice: 10.5, LineTotal: 10.5}},
+			10.5,
+		},
+		{
+			"line item order",
+			Order{Items: []LineItem{{SKU: "sku-1", Quantity: 2, UnitPrice: 1.5}, {SKU: "sku-2", Quantity: 3, UnitPrice: 0.1}}},
+			[]LineItem{{SKU: "sku-1", Quantity: 2, UnitPrice: 1.5, LineTotal: 3}, {SKU: "sku-2", Quantity: 3, UnitPrice: 0.1, LineTotal: 0.3}},
+			3.3,
+		},
+		{
+			"line totals rounded half up",
+			Order{Items: []LineItem{{SKU: "sku-1", Quantity: 1, UnitPrice: 0.125}, {SKU: "sku-2", Quantity: 1, UnitPrice: 0.125}}},
+			[]LineItem{{SKU: "sku-1", Quantity: 1, UnitPrice: 0.125, LineTotal: 0.13}, {SKU: "sku-2", Quantity: 1, UnitPrice: 0.125, LineTotal: 0.13}},
+			0.26,
+		},
+		{
+			"line totals sent by the client",
+			Order{Items: []LineItem{{SKU: "sku-1", Quantity: 2, UnitPrice: 5, LineTotal: 1}}, Total: 1},
+			[]LineItem{{SKU: "sku-1", Quantity: 2, UnitPrice: 5, LineTotal: 10}},
+			10,
+		},
+		{"free items", Order{Items: []LineItem{{SKU: "sku-1", Quantity: 4}}}, []LineItem{{SKU: "sku-1", Quantity: 4}}, 0},
+	} {
+		order := test.order
+		PriceOrder(&order)
+		if !reflect.DeepEqual(order.Items, test.items) {
+			t.Errorf("PriceOrder of the %s returned the items %+v, expected %+v", test.name, order.Items, test.items)
+		}
+		if order.Subtotal != test.subtotal || order.Total != test.subtotal {
+			t.Errorf("PriceOrder of the %s returned the subtotal %v and total %v, expected %v", test.name, order.Subtotal, order.Total, test.subtotal)
+		}
+	}
+}
+
+func TestRoundToCents(t *testing.T) {
+	for amount, expected := range map[float64]float64{
+		0:         0,
+		1.234:     1.23,
+		0.125:     0.13,
+		-0.125:    -0.13,
+		0.005:     0.01,
+		19.999:    20,
+		0.1 + 0.2: 0.3,
+		2.5:       2.5,
+		-1.234:    -1.23,
+	} {
+		if rounded := roundToCents(amount); rounded != expected {
+			t.Errorf("roundToCents(%v) returned %v, expected %v", amount, rounded, expected)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package models
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryOrderStore is an OrderStore, IdempotencyStore and Outbox that keeps everything in memory.
+// It needs no outside services, which makes it handy for local development and tests,
+// but everything is lost when the process stops. It is safe for concurrent use.
+type MemoryOrderStore struct {
+	mu          sync.RWMutex
+	orders      map[primitive.ObjectID]Order
+	idempotency map[string]IdempotencyRecord
+	outbox      map[primitive.ObjectID]OutboxMessage
+}
+
+// NewMemoryOrderStore returns an empty in-memory store
+func NewMemoryOrderStore() *MemoryOrderStore {
+	return &MemoryOrderStore{
+		orders:      map[primitive.ObjectID]Order{},
+		idempotency: map[string]IdempotencyRecord{},
+		outbox:      map[primitive.ObjectID]OutboxMessage{},
+	}
+}
+
+// Create adds the order and its outbox message to memory
+func (s *MemoryOrderStore) Create(order Order) (Order, error) {
+	prepareNewOrder(&order)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addOrder(order)
+	return order, nil
+}
+
+// CreateMany adds a batch of orders to memory. Storing in memory can't fail,
+// so every error is nil.
+func (s *MemoryOrderStore) CreateMany(orders []Order) ([]Order, []error) {
+	for i := range orders {
+		prepareNewOrder(&orders[i])
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, order := range orders {
+		s.addOrder(order)
+	}
+	return orders, make([]error, len(orders))
+}
+
+// Get returns a single order by its hex ID
+func (s *MemoryOrderStore) Get(orderID string) (Order, error) {
+	id, err := primitive.ObjectIDFromHex(orderID)
+	if err != nil {
+		return Order{}, ErrInvalidOrderID
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	order, ok := s.orders[id]
+	if !ok {
+		return Order{}, ErrOrderNotFound
+	}
+	return cloneOrder(order), nil
+}
+
+// List returns a page of orders matching the filter, with the same ordering and cursors as MongoOrderStore
+func (s *MemoryOrderStore) List(filter OrderFilter) (OrderPage, error) {
+	page := OrderPage{Orders: []Order{}}
+
+	var lastID string
+	if filter.Cursor != "" {
+		id, err := decodeOrderCursor(filter.Cursor)
+		if err != nil {
+			return page, err
+		}
+		lastID = id.Hex()
+	}
+
+	limit := pageSize(filter.Limit)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, order := range s.sortedOrders(filter.NewestFirst) {
+		if lastID != "" && ((filter.NewestFirst && order.ID.Hex() >= lastID) || (!filter.NewestFirst && order.ID.Hex() <= lastID)) {
+			continue
+		}
+		if !matchesOrderFilter(order, filter) {
+			continue
+		}
+		if len(page.Orders) == limit {
+			page.NextCursor = encodeOrderCursor(page.Orders[limit-1].ID)
+			break
+		}
+		page.Orders = append(page.Orders, cloneOrder(order))
+	}
+	return page, nil
+}
+
+// Count returns the number of orders in memory
+func (s *MemoryOrderStore) Count() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.orders), nil
+}
+
+// UpdateStatus applies transition to an order in memory, provided it is still at the version it was read at.
+// A cancellation message is added to the outbox under the same lock.
+func (s *MemoryOrderStore) UpdateStatus(read Order, transition StatusTransition, cancellation *Cancellation) (Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stored, ok := s.orders[read.ID]; !ok || stored.Version != read.Version {
+		return Order{}, ErrVersionConflict
+	}
+
+	order := applyStatusTransition(read, transition, cancellation)
+	if cancellation != nil {
+		message := newOrderCancelledOutboxMessage(order)
+		s.outbox[message.ID] = message
+	}
+	stored := cloneOrder(order)
+	stored.CorrelationID = "" // not stored, like in the other stores
+	s.orders[order.ID] = stored
+
+	return order, nil
+}
+
+// CustomerOrders returns the customer order history for a normalized email address from memory
+func (s *MemoryOrderStore) CustomerOrders(normalized string, limit int) (CustomerOrderHistory, error) {
+	history := CustomerOrderHistory{EmailAddress: normalized, Orders: []Order{}}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, order := range s.sortedOrders(true) {
+		if order.EmailAddressNormalized != normalized {
+			continue
+		}
+		history.OrderCount++
+		if order.Status != StatusCancelled && order.Status != StatusFailed {
+			history.LifetimeValue += order.Total
+		}
+		if len(history.Orders) < limit {
+			history.Orders = append(history.Orders, cloneOrder(order))
+		}
+	}
+	history.LifetimeValue = roundToCents(history.LifetimeValue)
+
+	return history, nil
+}
+
+// BeginIdempotentRequest reserves key for a request with the given hash, see IdempotencyStore
+func (s *MemoryOrderStore) BeginIdempotentRequest(key string, requestHash string) (*IdempotencyRecord, string, error) {
+	if len(key) > MaxIdempotencyKeyLength {
+		return nil, "", ErrIdempotencyKeyTooLong
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.idempotency[key]; ok && !existing.expired() {
+		return &existing, "", nil
+	}
+
+	record := IdempotencyRecord{Key: key, RequestHash: requestHash, CreatedAt: time.Now().UTC(), Reservation: newIdempotencyReservation()}
+	s.idempotency[key] = record
+	return nil, record.Reservation, nil
+}
+
+// CompleteIdempotentRequest stores the response of a request reserved with BeginIdempotentRequest,
+// unless another request took the key over since
+func (s *MemoryOrderStore) CompleteIdempotentRequest(key string, reservation string, orderID string, statusCode int, response []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.idempotency[key]
+	if !ok || record.Reservation != reservation || !record.Pending() {
+		return ErrIdempotencyReservationLost
+	}
+	record.OrderID = orderID
+	record.StatusCode = statusCode
+	record.Response = append([]byte(nil), response...)
+	s.idempotency[key] = record
+	return nil
+}
+
+// ReleaseIdempotentRequest forgets a key reserved with BeginIdempotentRequest
+// so that a request which failed can be retried with the same key.
+func (s *MemoryOrderStore) ReleaseIdempotentRequest(key string, reservation string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.idempotency[key]
+	if !ok || record.Reservation != reservation || !record.Pending() {
+		return ErrIdempotencyReservationLost
+	}
+	delete(s.idempotency, key)
+	return nil
+}
+
+// ClaimOutboxMessages claims due messages in memory, oldest first, see Outbox
+func (s *MemoryOrderStore) ClaimOutboxMessages(limit int, lease time.Duration) ([]OutboxMessage, error) {
+	now := time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := []OutboxMessage{}
+	for _, message := range s.outbox {
+		if !message.NextAttemptAt.After(now) {
+			messages = append(messages, message)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].NextAttemptAt.Before(messages[j].NextAttemptAt)
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+
+	for _, message := range messages {
+		message.NextAttemptAt = now.Add(lease)
+		s.outbox[message.ID] = message
+	}
+	return messages, nil
+}
+
+// MarkOutboxMessageDelivered forgets a delivered message, there is no need to keep it in memory
+func (s *MemoryOrderStore) MarkOutboxMessageDelivered(message OutboxMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.outbox, message.ID)
+	return nil
+}
+
+// RetryOutboxMessage records a failed attempt to send a message in memory
+func (s *MemoryOrderStore) RetryOutboxMessage(claimed OutboxMessage, nextAttemptAt time.Time, lastError string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if message, ok := s.outbox[claimed.ID]; ok {
+		message.Attempts++
+		message.NextAttemptAt = nextAttemptAt
+		message.LastError = lastError
+		s.outbox[claimed.ID] = message
+	}
+	return nil
+}
+
+// ExpiredOrders returns a page of orders in memory past their retention, see OrderArchiver
+func (s *MemoryOrderStore) ExpiredOrders(cutoff time.Time, afterID primitive.ObjectID, limit int) ([]Order, error) {
+	orders := []Order{}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, order := range s.sortedOrders(false) {
+		if len(orders) == limit {
+			break
+		}
+		if order.ID.Hex() > afterID.Hex() && IsTerminalStatus(order.Status) && order.CreatedAt.Before(cutoff) {
+			orders = append(orders, cloneOrder(order))
+		}
+	}
+	return orders, nil
+}
+
+// DeleteOrders removes archived orders from memory
+func (s *MemoryOrderStore) DeleteOrders(ids []primitive.ObjectID) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for _, id := range ids {
+		if _, ok := s.orders[id]; ok {
+			delete(s.orders, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// addOrder stores a prepared order along with its outbox message.
+// The caller must hold the lock.
+func (s *MemoryOrderStore) addOrder(order Order) {
+	stored := cloneOrder(order)
+	stored.CorrelationID = "" // not stored, like in the other stores
+	s.orders[order.ID] = stored
+	message := newOrderAddedOutboxMessage(order)
+	s.outbox[message.ID] = message
+}
+
+// sortedOrders returns the orders sorted by ID, which sorts them by creation time.
+// Hex IDs sort the same as the ObjectIds they encode.
+// The caller must hold the lock.
+func (s *MemoryOrderStore) sortedOrders(newestFirst bool) []Order {
+	orders := make([]Order, 0, len(s.orders))
+	for _, order := range s.orders {
+		orders = append(orders, order)
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		if newestFirst {
+			return orders[i].ID.Hex() > orders[j].ID.Hex()
+		}
+		return orders[i].ID.Hex() < orders[j].ID.Hex()
+	})
+	return orders
+}
+
+// matchesOrderFilter reports whether order matches the filter, except for its cursor
+func matchesOrderFilter(order Order, filter OrderFilter) bool {
+	if filter.Status != "" && order.Status != filter.Status {
+		return false
+	}
+	if filter.EmailAddress != "" && order.EmailAddress != filter.EmailAddress {
+		return false
+	}
+	if !filter.CreatedFrom.IsZero() && order.CreatedAt.Before(filter.CreatedFrom) {
+		return false
+	}
+	if !filter.CreatedTo.IsZero() && !order.CreatedAt.Before(filter.CreatedTo) {
+		return false
+	}
+	if filter.Product != "" {
+		// Orders stored before line items only have the product field
+		if order.Product == filter.Product {
+			return true
+		}
+		for _, item := range order.Items {
+			if item.SKU == filter.Product {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// cloneOrder copies an order so that callers can't change the stored one through its slices
+func cloneOrder(order Order) Order {
+	order.Items = append([]LineItem(nil), order.Items...)
+	order.StatusHistory = append([]StatusTransition(nil), order.StatusHistory...)
+	if order.Cancellation != nil {
+		c := *order.Cancellation
+		order.Cancellation = &c
+	}
+	return order
+}
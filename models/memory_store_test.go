@@ -0,0 +1,288 @@
+package models
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestOrder(emailAddress string, sku string) Order {
+	return Order{EmailAddress: emailAddress, Items: []LineItem{{SKU: sku, Quantity: 2, UnitPrice: 1.25}}}
+}
+
+func TestMemoryOrderStoreCreateAndGet(t *testing.T) {
+	store := NewMemoryOrderStore()
+
+	created, err := store.Create(newTestOrder("Jane@example.com", "sku-1"))
+	if err != nil {
+		t.Fatalf("Create returned %v", err)
+	}
+	if created.ID.IsZero() || created.Status != StatusOpen || created.Total != 2.5 {
+		t.Errorf("Create returned an unprepared order: %+v", created)
+	}
+
+	order, err := store.Get(created.ID.Hex())
+	if err != nil {
+		t.Fatalf("Get returned %v", err)
+	}
+	if order.ID != created.ID || len(order.StatusHistory) != 1 {
+		t.Errorf("Get returned %+v, expected %+v", order, created)
+	}
+
+	// Changing the returned order must not change the stored one
+	order.Items[0].SKU = "changed"
+	if again, _ := store.Get(created.ID.Hex()); again.Items[0].SKU != "sku-1" {
+		t.Error("The stored order changed through the order returned by Get")
+	}
+
+	if _, err := store.Get("not-an-id"); err != ErrInvalidOrderID {
+		t.Errorf("Get of an invalid ID returned %v", err)
+	}
+	if _, err := store.Get("5b9f2c3e8d1a4f0001a1b2c3"); err != ErrOrderNotFound {
+		t.Errorf("Get of an unknown ID returned %v", err)
+	}
+}
+
+func TestMemoryOrderStoreList(t *testing.T) {
+	store := NewMemoryOrderStore()
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		sku := "sku-even"
+		if i%2 == 1 {
+			sku = "sku-odd"
+		}
+		order, _ := store.Create(newTestOrder("jane@example.com", sku))
+		ids = append(ids, order.ID.Hex())
+	}
+
+	// Walk all pages oldest first
+	var listed []string
+	filter := OrderFilter{Limit: 2}
+	for {
+		page, err := store.List(filter)
+		if err != nil {
+			t.Fatalf("List returned %v", err)
+		}
+		for _, order := range page.Orders {
+			listed = append(listed, order.ID.Hex())
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		filter.Cursor = page.NextCursor
+	}
+	if len(listed) != len(ids) {
+		t.Fatalf("Listed %d orders, expected %d", len(listed), len(ids))
+	}
+	for i := range ids {
+		if listed[i] != ids[i] {
+			t.Errorf("Order %d listed as %s, expected %s", i, listed[i], ids[i])
+		}
+	}
+
+	page, _ := store.List(OrderFilter{Product: "sku-odd", NewestFirst: true})
+	if len(page.Orders) != 2 || page.Orders[0].ID.Hex() != ids[3] || page.NextCursor != "" {
+		t.Errorf("Listing by product returned %+v", page)
+	}
+
+	if _, err := store.List(OrderFilter{Cursor: "!"}); err != ErrInvalidCursor {
+		t.Errorf("List with an invalid cursor returned %v", err)
+	}
+}
+
+func TestMemoryOrderStoreTransitions(t *testing.T) {
+	store := NewMemoryOrderStore()
+	created, _ := store.Create(newTestOrder("jane@example.com", "sku-1"))
+
+	order, err := TransitionOrderStatus(store, created.ID.Hex(), AnyVersion, StatusConfirmed, "paid", "billing")
+	if err != nil || order.Status != StatusConfirmed || len(order.StatusHistory) != 2 {
+		t.Fatalf("TransitionOrderStatus returned %+v, %v", order, err)
+	}
+
+	order, err = CancelOrder(store, created.ID.Hex(), AnyVersion, "changed my mind", "jane", "correlation-1")
+	if err != nil || order.Status != StatusCancelled || order.Cancellation == nil {
+		t.Fatalf("CancelOrder returned %+v, %v", order, err)
+	}
+	// Fulfillment is told through the outbox, along with the created message
+	cancelled := 0
+	for _, message := range store.outbox {
+		if event := decodeOutboxEvent(message); event.Type == OrderCancelledEventType {
+			cancelled++
+			if event.Subject != created.ID.Hex() || event.CorrelationID != "correlation-1" || !event.Time.Equal(order.Cancellation.At) {
+				t.Errorf("The cancellation was stored with the event %+v", event)
+			}
+		}
+	}
+	if cancelled != 1 || len(store.outbox) != 2 {
+		t.Errorf("The outbox has %d messages, %d of them cancellations", len(store.outbox), cancelled)
+	}
+	if stored, _ := store.Get(created.ID.Hex()); stored.CorrelationID != "" {
+		t.Errorf("The correlation ID %q was stored with the order", stored.CorrelationID)
+	}
+
+	_, err = TransitionOrderStatus(store, created.ID.Hex(), AnyVersion, StatusFulfilled, "", "")
+	if transitionErr, ok := err.(*TransitionError); !ok || transitionErr.From != StatusCancelled {
+		t.Errorf("Fulfilling a cancelled order returned %v", err)
+	}
+
+	// A stale transition must not be applied
+	stale := StatusTransition{From: StatusOpen, To: StatusConfirmed}
+	if _, err := store.UpdateStatus(created, stale, nil); err != ErrVersionConflict {
+		t.Errorf("UpdateStatus at a stale version returned %v", err)
+	}
+}
+
+func TestMemoryOrderStoreVersions(t *testing.T) {
+	store := NewMemoryOrderStore()
+	created, _ := store.Create(newTestOrder("jane@example.com", "sku-1"))
+	if created.Version != 1 {
+		t.Fatalf("A new order is at version %d, expected 1", created.Version)
+	}
+
+	order, err := TransitionOrderStatus(store, created.ID.Hex(), 1, StatusConfirmed, "", "billing")
+	if err != nil || order.Version != 2 {
+		t.Fatalf("TransitionOrderStatus at the current version returned %+v, %v", order, err)
+	}
+
+	_, err = CancelOrder(store, created.ID.Hex(), 1, "changed my mind", "jane", "")
+	if staleErr, ok := err.(*StaleVersionError); !ok || staleErr.Current != 2 {
+		t.Errorf("CancelOrder at a stale version returned %v", err)
+	}
+	if order, _ := store.Get(created.ID.Hex()); order.Status != StatusConfirmed || order.Version != 2 {
+		t.Errorf("The order changed at a stale version: %+v", order)
+	}
+}
+
+func TestMemoryOrderStoreCustomerOrders(t *testing.T) {
+	store := NewMemoryOrderStore()
+	store.Create(newTestOrder("Jane@Example.com", "sku-1"))
+	store.Create(newTestOrder("jane@example.com", "sku-2"))
+	cancelled, _ := store.Create(newTestOrder("jane@example.com", "sku-3"))
+	store.Create(newTestOrder("john@example.com", "sku-1"))
+	CancelOrder(store, cancelled.ID.Hex(), AnyVersion, "duplicate", "jane", "")
+
+	history, err := GetCustomerOrderHistory(store, " JANE@example.com", 2)
+	if err != nil {
+		t.Fatalf("GetCustomerOrderHistory returned %v", err)
+	}
+	if history.OrderCount != 3 || len(history.Orders) != 2 || history.LifetimeValue != 5 {
+		t.Errorf("GetCustomerOrderHistory returned %+v", history)
+	}
+	if history.Orders[0].ID != cancelled.ID {
+		t.Errorf("The newest order wasn't listed first")
+	}
+}
+
+func TestMemoryOrderStoreIdempotency(t *testing.T) {
+	store := NewMemoryOrderStore()
+
+	existing, reservation, err := store.BeginIdempotentRequest("key", "hash")
+	if existing != nil || reservation == "" || err != nil {
+		t.Fatalf("First BeginIdempotentRequest returned %v, %q, %v", existing, reservation, err)
+	}
+	if existing, _, _ := store.BeginIdempotentRequest("key", "hash"); existing == nil || !existing.Pending() {
+		t.Errorf("BeginIdempotentRequest of a pending key returned %v", existing)
+	}
+
+	if err := store.CompleteIdempotentRequest("key", reservation, "order", 200, []byte("{}")); err != nil {
+		t.Errorf("CompleteIdempotentRequest returned %v", err)
+	}
+	if err := store.ReleaseIdempotentRequest("key", reservation); err != ErrIdempotencyReservationLost {
+		t.Errorf("ReleaseIdempotentRequest of a completed key returned %v, expected %v", err, ErrIdempotencyReservationLost)
+	}
+	existing, _, _ = store.BeginIdempotentRequest("key", "hash")
+	if existing == nil || existing.StatusCode != 200 || string(existing.Response) != "{}" {
+		t.Errorf("BeginIdempotentRequest of a completed key returned %v", existing)
+	}
+
+	_, reservation, _ = store.BeginIdempotentRequest("failed", "hash")
+	store.ReleaseIdempotentRequest("failed", reservation)
+	if existing, _, _ := store.BeginIdempotentRequest("failed", "hash"); existing != nil {
+		t.Errorf("A released key was remembered: %v", existing)
+	}
+
+	// A reservation whose request never completed is given to a single one of the requests racing for it
+	_, reservation, _ = store.BeginIdempotentRequest("abandoned", "hash")
+	abandoned := store.idempotency["abandoned"]
+	abandoned.CreatedAt = abandoned.CreatedAt.Add(-idempotencyPendingLease - time.Second)
+	store.idempotency["abandoned"] = abandoned
+	if reserved := raceIdempotentRequests(store, "abandoned"); reserved != 1 {
+		t.Errorf("%d requests reserved the abandoned key, expected 1", reserved)
+	}
+	// and the slow original request can no longer complete or release it
+	if err := store.CompleteIdempotentRequest("abandoned", reservation, "order", 200, []byte("{}")); err != ErrIdempotencyReservationLost {
+		t.Errorf("CompleteIdempotentRequest of a key taken over returned %v, expected %v", err, ErrIdempotencyReservationLost)
+	}
+	if err := store.ReleaseIdempotentRequest("abandoned", reservation); err != ErrIdempotencyReservationLost {
+		t.Errorf("ReleaseIdempotentRequest of a key taken over returned %v, expected %v", err, ErrIdempotencyReservationLost)
+	}
+	if existing, _, _ := store.BeginIdempotentRequest("abandoned", "hash"); existing == nil || !existing.Pending() {
+		t.Errorf("The new reservation of the key was overwritten: %v", existing)
+	}
+
+	// Completed keys are kept for the whole idempotency window
+	completed := store.idempotency["key"]
+	completed.CreatedAt = completed.CreatedAt.Add(-idempotencyPendingLease - time.Second)
+	store.idempotency["key"] = completed
+	if existing, _, _ := store.BeginIdempotentRequest("key", "hash"); existing == nil || existing.StatusCode != 200 {
+		t.Errorf("BeginIdempotentRequest of a completed key past the pending lease returned %v", existing)
+	}
+}
+
+// raceIdempotentRequests begins requests with the same key concurrently and returns how many reserved it
+func raceIdempotentRequests(store IdempotencyStore, key string) int {
+	results := make(chan bool, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(results); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			existing, _, err := store.BeginIdempotentRequest(key, "hash")
+			results <- err == nil && existing == nil
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	reserved := 0
+	for ok := range results {
+		if ok {
+			reserved++
+		}
+	}
+	return reserved
+}
+
+func TestMemoryOrderStoreConcurrency(t *testing.T) {
+	store := NewMemoryOrderStore()
+	created, _ := store.Create(newTestOrder("jane@example.com", "sku-1"))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	confirmed := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			store.Create(newTestOrder("jane@example.com", "sku-2"))
+			store.List(OrderFilter{})
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := TransitionOrderStatus(store, created.ID.Hex(), AnyVersion, StatusConfirmed, "", "test"); err == nil {
+				mu.Lock()
+				confirmed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count, _ := store.Count(); count != 51 {
+		t.Errorf("Count returned %d, expected 51", count)
+	}
+	if confirmed != 1 {
+		t.Errorf("The order was confirmed %d times, expected once", confirmed)
+	}
+}
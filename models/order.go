@@ -2,9 +2,10 @@ package models
 
 import (
 	"crypto/tls"
-	"net"
 	"net/url"
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
 
@@ -16,22 +17,73 @@ import (
 	"time"
 
 	//"github.com/Microsoft/ApplicationInsights-Go/appinsights"
-    "gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
-	amqp10 "pack.ag/amqp"
-	"gopkg.in/matryer/try.v1"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // Order represents the order json
 type Order struct {
-	ID           			bson.ObjectId		`json:"id" bson:"_id,omitempty"`
-	EmailAddress      string  				`json:"emailAddress"`
-	Product           string  				`json:"product"`
-	Total             float64 				`json:"total"`
-	Status            string  				`json:"status"`
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	EmailAddress string             `json:"emailAddress"`
+	Product      string             `json:"product,omitempty"` // legacy single product orders, see PriceOrder
+	Items        []LineItem         `json:"items" bson:"items,omitempty"`
+	Subtotal     float64            `json:"subtotal"`
+	Total        float64            `json:"total"`
+	Status       string             `json:"status"`
+	CreatedAt    time.Time          `json:"createdAt" bson:"createdAt"`
+
+	StatusHistory []StatusTransition `json:"statusHistory" bson:"statusHistory,omitempty"`
+	Cancellation  *Cancellation      `json:"cancellation,omitempty" bson:"cancellation,omitempty"`
+
+	// Version is incremented by every update, which only applies to the version it was read at.
+	// Orders stored before versions were introduced are at version 0.
+	Version int64 `json:"version" bson:"version"`
+
+	// Lower-cased EmailAddress, indexed to look up a customer's orders
+	EmailAddressNormalized string `json:"-" bson:"emailAddressNormalized"`
+
+	// CorrelationID of the request that created or changed the order, carried by the events about it but not stored
+	CorrelationID string `json:"-" bson:"-"`
 }
 
+// OrderFilter holds the criteria used to list a page of orders
+type OrderFilter struct {
+	Status       string
+	Product      string
+	EmailAddress string
+	CreatedFrom  time.Time // inclusive, ignored when zero
+	CreatedTo    time.Time // exclusive, ignored when zero
+	NewestFirst  bool
+	Cursor       string // NextCursor of the previous page, empty for the first page
+	Limit        int
+}
+
+// OrderPage is a single page of orders and the cursor to fetch the next one
+type OrderPage struct {
+	Orders     []Order `json:"orders"`
+	NextCursor string  `json:"nextCursor,omitempty"`
+}
+
+// Page size limits for OrderStore.List
+const (
+	DefaultOrderPageSize = 20
+	MaxOrderPageSize     = 100
+)
+
+// Errors returned when looking up a single order
+var (
+	// ErrInvalidOrderID is returned when the order ID is not a valid hex ObjectId
+	ErrInvalidOrderID = errors.New("order id is not a valid hex ObjectId")
+	// ErrOrderNotFound is returned when no order exists with the given ID
+	ErrOrderNotFound = errors.New("order not found")
+	// ErrInvalidCursor is returned when a pagination cursor can't be decoded
+	ErrInvalidCursor = errors.New("cursor is not valid")
+)
+
 // Environment variables
+var mongoURI = os.Getenv("MONGOURI")
 var mongoHost = os.Getenv("MONGOHOST")
 var mongoUsername = os.Getenv("MONGOUSER")
 var mongoPassword = os.Getenv("MONGOPASSWORD")
@@ -39,31 +91,47 @@ var mongoSSL = false
 var mongoPort = ""
 var amqpURL = os.Getenv("AMQPURL")
 var teamName = os.Getenv("TEAMNAME")
+var orderStoreBackend = os.Getenv("ORDERSTORE")
+var sqlDataSourceName = os.Getenv("SQLDSN")
 var mongoPoolLimit = 25
 
-// MongoDB variables
-var mongoDBSession *mgo.Session
-var mongoDBSessionError error
+// How long a single MongoDB operation may take
+var mongoTimeout = 30 * time.Second
 
-// MongoDB database and collection names
-var mongoDatabaseName = "akschallenge"
-var mongoCollectionName = "orders"
-var mongoCollectionShardKey = "_id"
-
-// AMQP 1.0 variables
-var amqp10Client *amqp10.Client
-var amqp10Session *amqp10.Session
-var amqpSender *amqp10.Sender
-var serivceBusName string
+// MongoDB database and collection names. Override with the MONGODATABASE, MONGOCOLLECTION and MONGOSHARDKEY
+// environment variables. Without MONGODATABASE the database in the path of MONGOURI is used, if any.
+var mongoDatabaseName = getEnv("MONGODATABASE", "akschallenge")
+var mongoCollectionName = getEnv("MONGOCOLLECTION", "orders")
+var mongoCollectionShardKey = getEnv("MONGOSHARDKEY", "_id")
 
 // Application Insights telemetry clients
 //var ChallengeTelemetryClient appinsights.TelemetryClient
 //var CustomTelemetryClient appinsights.TelemetryClient
 
 // For tracking and code branching purposes
-var isCosmosDb = strings.Contains(mongoHost, "documents.azure.com")
+var isCosmosDb = strings.Contains(mongoHost, "documents.azure.com") || strings.Contains(mongoURI, "documents.azure.com")
 var db string // CosmosDB or MongoDB?
 
+// MongoOrderStore is the OrderStore, IdempotencyStore and Outbox backed by MongoDB/CosmosDB
+type MongoOrderStore struct {
+	// mongoDBClient maintains a pool of connections to MongoDB and is safe for concurrent use
+	mongoDBClient *mongo.Client
+}
+
+// NewMongoOrderStore connects to the MongoDB/CosmosDB set by the MONGO* environment variables
+// and prepares the orders collection.
+func NewMongoOrderStore() (*MongoOrderStore, error) {
+	s := &MongoOrderStore{}
+	if err := s.initMongo(); err != nil {
+		return nil, err
+	}
+	s.initOrderIndexes()
+	s.initIdempotency()
+	s.initNormalizedEmailBackfill()
+	s.initOutbox()
+	return s, nil
+}
+
 // ReadMongoPasswordFromSecret reads the mongo password from the flexvol mount if present
 func ReadMongoPasswordFromSecret(file string) (string, error) {
 	b, err := ioutil.ReadFile(file)
@@ -76,31 +144,34 @@ func ReadMongoPasswordFromSecret(file string) (string, error) {
 
 }
 
-// AddOrderToMongoDB Adds the order to MongoDB/CosmosDB
-func AddOrderToMongoDB(order Order) (string, error) {
+// Create Adds the order to MongoDB/CosmosDB with its outbox message embedded in the order document.
+// A single document write is atomic without a transaction, so the order is only stored if it will be
+// announced on AMQP, on a standalone server as well as on CosmosDB.
+func (s *MongoOrderStore) Create(order Order) (Order, error) {
 	//success := false
 	//startTime := time.Now()
 
-	// Use the existing mongoDBSessionCopy
-	mongoDBSessionCopy := mongoDBSession.Copy()
-	defer mongoDBSessionCopy.Close()
+	ctx, cancel := mongoContext()
+	defer cancel()
 
-	order.ID = bson.NewObjectId()
+	prepareNewOrder(&order)
 	StringOrderID := order.ID.Hex()
-	order.Status = "Open"
 
 	log.Println("Inserting into MongoDB URL: ", mongoHost, " CosmosDB: ", isCosmosDb)
 
 	// insert Document in collection
-	mongoDBCollection := mongoDBSessionCopy.DB(mongoDatabaseName).C(mongoCollectionName)
-	mongoDBSessionError = mongoDBCollection.Insert(order)
+	doc := newMongoOrderDocument(order)
+	err := retryThrottled(ctx, "insert order", func() error {
+		_, err := s.orders().InsertOne(ctx, doc)
+		return err
+	})
 
-	if mongoDBSessionError != nil {
+	if err != nil {
 		// If the team provided an Application Insights key, let's track that exception
 		//if CustomTelemetryClient != nil {
-		//	CustomTelemetryClient.TrackException(mongoDBSessionError)
+		//	CustomTelemetryClient.TrackException(err)
 		//}
-		printErr("Problem inserting data: ", mongoDBSessionError)
+		printErr("Problem inserting data: ", err)
 	} else {
 		log.Println("Inserted order:", StringOrderID)
 		//success = true
@@ -132,8 +203,8 @@ func AddOrderToMongoDB(order Order) (string, error) {
 				success)
 			dependency.Data = "Insert order"		
 
-			if mongoDBSessionError != nil {
-				dependency.ResultCode = mongoDBSessionError.Error()
+			if err != nil {
+				dependency.ResultCode = err.Error()
 			}
 				
 			dependency.MarkTime(startTime, endTime)
@@ -146,8 +217,8 @@ func AddOrderToMongoDB(order Order) (string, error) {
 				success)
 			dependency.Data = "Insert order"	
 
-			if mongoDBSessionError != nil {
-				dependency.ResultCode = mongoDBSessionError.Error()
+			if err != nil {
+				dependency.ResultCode = err.Error()
 			}
 
 			dependency.MarkTime(startTime, endTime)
@@ -155,33 +226,37 @@ func AddOrderToMongoDB(order Order) (string, error) {
 		}
 	}
 	*/
-	if(mongoDBSessionError != nil) {
-		printErr("MongoDB session error while inserting order: ", mongoDBSessionError.Error())
+	if(err != nil) {
+		printErr("MongoDB session error while inserting order: ", err.Error())
 	}
-	return StringOrderID, mongoDBSessionError
+	return order, err
 }
 
-// GetNumberOfOrdersInDB
-func GetNumberOfOrdersInDB() (int, error) {
+// Count returns the number of orders in MongoDB/CosmosDB
+func (s *MongoOrderStore) Count() (int, error) {
 	//success := false
 	//startTime := time.Now()
 
-	// Use the existing mongoDBSessionCopy
-	mongoDBSessionCopy := mongoDBSession.Copy()
-	defer mongoDBSessionCopy.Close()
+	ctx, cancel := mongoContext()
+	defer cancel()
 
 	log.Println("Querying MongoDB URL: ", mongoHost, " CosmosDB: ", isCosmosDb)
 
-	// get the Document in collection
-	mongoDBCollection := mongoDBSessionCopy.DB(mongoDatabaseName).C(mongoCollectionName)
-	orderCount,mongoDBSessionError := mongoDBCollection.Count()
+	// count the Documents in collection from the collection metadata, which is cheaper than counting them
+	var count int64
+	err := retryThrottled(ctx, "count orders", func() error {
+		var err error
+		count, err = s.orders().EstimatedDocumentCount(ctx)
+		return err
+	})
+	orderCount := int(count)
 
-	if mongoDBSessionError != nil {
+	if err != nil {
 		// If the team provided an Application Insights key, let's track that exception
 		//if CustomTelemetryClient != nil {
-		//	CustomTelemetryClient.TrackException(mongoDBSessionError)
+		//	CustomTelemetryClient.TrackException(err)
 		//}
-		printErr("Problem quering number of orders: ", mongoDBSessionError)
+		printErr("Problem quering number of orders: ", err)
 	} else {
 		log.Println("Order count:", orderCount)
 		//success = true
@@ -211,8 +286,8 @@ func GetNumberOfOrdersInDB() (int, error) {
 				success)
 			dependency.Data = "Count orders"		
 
-			if mongoDBSessionError != nil {
-				dependency.ResultCode = mongoDBSessionError.Error()
+			if err != nil {
+				dependency.ResultCode = err.Error()
 			}
 				
 			dependency.MarkTime(startTime, endTime)
@@ -225,8 +300,8 @@ func GetNumberOfOrdersInDB() (int, error) {
 				success)
 			dependency.Data = "Count orders"	
 
-			if mongoDBSessionError != nil {
-				dependency.ResultCode = mongoDBSessionError.Error()
+			if err != nil {
+				dependency.ResultCode = err.Error()
 			}
 
 			dependency.MarkTime(startTime, endTime)
@@ -235,23 +310,159 @@ func GetNumberOfOrdersInDB() (int, error) {
 	}
 	*/
 
-	if(mongoDBSessionError != nil) {
-		printErr("MongoDB session error while retreiving count: ", mongoDBSessionError.Error())
+	if(err != nil) {
+		printErr("MongoDB session error while retreiving count: ", err.Error())
 	}
-	return orderCount, mongoDBSessionError
+	return orderCount, err
 }
 
-// AddOrderToAMQP Adds the order to AMQP (Service Bus Queue)
-func AddOrderToAMQP(orderId string)  bool {
-	if (false) { // dumb disable
-		if amqpURL != "" {
-			return addOrderToAMQP10(orderId)
-		} else {
-			log.Println("Skipping inserting to Service Bus because it isn't configured yet.")
-			return true
+// Get retrieves a single order from MongoDB/CosmosDB by its hex ID
+func (s *MongoOrderStore) Get(orderID string) (Order, error) {
+	var order Order
+
+	id, err := primitive.ObjectIDFromHex(orderID)
+	if err != nil {
+		return order, ErrInvalidOrderID
+	}
+
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	log.Println("Querying MongoDB URL: ", mongoHost, " CosmosDB: ", isCosmosDb)
+
+	// get the Document from the collection
+	err = retryThrottled(ctx, "get order", func() error {
+		return s.orders().FindOne(ctx, bson.M{"_id": id}).Decode(&order)
+	})
+
+	if err == mongo.ErrNoDocuments {
+		return order, ErrOrderNotFound
+	}
+	if err != nil {
+		printErr("Problem retrieving order: ", err)
+		return order, err
+	}
+
+	log.Println("Retrieved order:", orderID)
+	return order, nil
+}
+
+// UpdateStatus applies transition to an order in MongoDB/CosmosDB, provided it is still at the version
+// it was read at. A cancellation message is embedded in the order by the same update, see mongoOrderDocument.
+func (s *MongoOrderStore) UpdateStatus(read Order, transition StatusTransition, cancellation *Cancellation) (Order, error) {
+	var order Order
+
+	set := bson.M{"status": transition.To}
+	push := bson.M{"statusHistory": transition}
+	if cancellation != nil {
+		set["cancellation"] = cancellation
+		push["outbox"] = newOrderCancelledOutboxMessage(applyStatusTransition(read, transition, cancellation))
+	}
+
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	log.Println("Updating MongoDB URL: ", mongoHost, " CosmosDB: ", isCosmosDb)
+
+	// Only update if nobody changed the order since it was read
+	filter := bson.M{"_id": read.ID, "version": read.Version}
+	if read.Version == 0 {
+		// Orders stored before versions were introduced have no version field
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	update := bson.M{
+		"$set":  set,
+		"$push": push,
+		"$inc":  bson.M{"version": 1},
+	}
+	err := retryThrottled(ctx, "update order status", func() error {
+		return s.orders().FindOneAndUpdate(ctx, filter, update,
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&order)
+	})
+
+	if err == mongo.ErrNoDocuments {
+		return order, ErrVersionConflict
+	}
+	if err != nil {
+		printErr("Problem updating order status: ", err)
+		return order, err
+	}
+
+	log.Printf("Order %s moved from %s to %s", read.ID.Hex(), transition.From, transition.To)
+	return order, nil
+}
+
+// List returns a page of orders in MongoDB/CosmosDB matching the filter.
+// Pages are keyed on _id rather than skip/limit so that paging stays cheap on the
+// hashed-shard CosmosDB collection. ObjectIds are time ordered, so sorting on _id
+// sorts by creation time.
+func (s *MongoOrderStore) List(filter OrderFilter) (OrderPage, error) {
+	page := OrderPage{Orders: []Order{}}
+
+	query := bson.M{}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+	if filter.Product != "" {
+		// Orders stored before line items only have the product field
+		query["$or"] = []bson.M{{"items.sku": filter.Product}, {"product": filter.Product}}
+	}
+	if filter.EmailAddress != "" {
+		query["emailAddress"] = filter.EmailAddress
+	}
+
+	createdAt := bson.M{}
+	if !filter.CreatedFrom.IsZero() {
+		createdAt["$gte"] = filter.CreatedFrom
+	}
+	if !filter.CreatedTo.IsZero() {
+		createdAt["$lt"] = filter.CreatedTo
+	}
+	if len(createdAt) > 0 {
+		query["createdAt"] = createdAt
+	}
+
+	sort := 1
+	cursorOperator := "$gt"
+	if filter.NewestFirst {
+		sort = -1
+		cursorOperator = "$lt"
+	}
+	if filter.Cursor != "" {
+		lastID, err := decodeOrderCursor(filter.Cursor)
+		if err != nil {
+			return page, err
+		}
+		query["_id"] = bson.M{cursorOperator: lastID}
+	}
+
+	limit := pageSize(filter.Limit)
+
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	log.Println("Querying MongoDB URL: ", mongoHost, " CosmosDB: ", isCosmosDb)
+
+	// Fetch one extra document to find out whether there is a next page
+	err := retryThrottled(ctx, "list orders", func() error {
+		cursor, err := s.orders().Find(ctx, query, options.Find().SetSort(bson.D{{Key: "_id", Value: sort}}).SetLimit(int64(limit+1)))
+		if err == nil {
+			err = cursor.All(ctx, &page.Orders)
 		}
+		return err
+	})
+	if err != nil {
+		printErr("Problem listing orders: ", err)
+		return page, err
+	}
+
+	if len(page.Orders) > limit {
+		page.Orders = page.Orders[:limit]
+		page.NextCursor = encodeOrderCursor(page.Orders[limit-1].ID)
 	}
-	return true
+
+	log.Println("Listed orders:", len(page.Orders))
+	return page, nil
 }
 
 //// BEGIN: NON EXPORTED FUNCTIONS
@@ -269,16 +480,24 @@ func init() {
 			fmt.Print(err)
 		}
 		mongoPassword = secret
-		fmt.Println(mongoPassword)
 	}
 
 	// Validate environment variables
+	validateVariable(redactMongoURI(mongoURI), "MONGOURI")
 	validateVariable(mongoHost, "MONGOHOST")
 	validateVariable(mongoUsername, "MONGOUSERNAME")
-	validateVariable(mongoPassword, "MONGOPASSWORD")
+	validateSecretVariable(mongoPassword, "MONGOPASSWORD")
 	//validateVariable(amqpURL, "AMQPURL")
 	validateVariable(teamName, "TEAMNAME")
 
+	var orderBatchLimitEnv = os.Getenv("ORDER_BATCH_LIMIT")
+	if orderBatchLimitEnv != "" {
+		if limit, err := strconv.Atoi(orderBatchLimitEnv); err == nil && limit > 0 {
+			MaxOrderBatchSize = limit
+		}
+	}
+	log.Printf("Order batch limit set to %v. You can override by setting the ORDER_BATCH_LIMIT environment variable.", MaxOrderBatchSize)
+
 	var mongoPoolLimitEnv = os.Getenv("MONGOPOOL_LIMIT")
 	if mongoPoolLimitEnv != "" {
 		if limit, err := strconv.Atoi(mongoPoolLimitEnv); err == nil {
@@ -287,13 +506,20 @@ func init() {
 	}
 	log.Printf("MongoDB pool limit set to %v. You can override by setting the MONGOPOOL_LIMIT environment variable." , mongoPoolLimit)
 
-	// Initialize the MongoDB client
-	initMongo()
+	initIdempotencyWindow()
+	initOutboxPollInterval()
+	initThrottleRetries()
+	initRetention()
+	initCloudEventsMode()
+	initAMQPMessages()
+}
 
-	// Initialize the AMQP client if AMQPURL is passed
-	if amqpURL != "" {
-		initAMQP()
+// getEnv returns the value of an environment variable, or fallback when it isn't set
+func getEnv(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
 	}
+	return fallback
 }
 
 // Logs out value of a variable
@@ -305,72 +531,47 @@ func validateVariable(value string, envName string) {
 	}
 }
 
-func initMongoDial() (success bool, mErr error) {
-	if isCosmosDb {
-		log.Println("Using CosmosDB")
-		db = "CosmosDB"
-		mongoSSL = true
-		mongoPort = ":10255"
-
+// Logs out whether a secret variable is set, without its value
+func validateSecretVariable(value string, envName string) {
+	if len(value) == 0 {
+		log.Printf("The environment variable %s has not been set", envName)
 	} else {
-		log.Println("Using MongoDB")
-		db = "MongoDB"
-		mongoSSL = false
-		mongoPort = ""
+		log.Printf("The environment variable %s is set", envName)
 	}
+}
 
-	// Parse the connection string to extract components because the MongoDB driver is peculiar
-	var dialInfo *mgo.DialInfo
-	
-	mongoDatabase := mongoDatabaseName // can be anything
-
-	log.Printf("\tUsername: %s", mongoUsername)
-	log.Printf("\tPassword: %s", mongoPassword)
-	log.Printf("\tHost: %s", mongoHost)
-	log.Printf("\tPort: %s", mongoPort)
-	log.Printf("\tDatabase: %s", mongoDatabase)
-	log.Printf("\tSSL: %t", mongoSSL)
-
-	if mongoSSL {
-		dialInfo = &mgo.DialInfo{
-			Addrs:    []string{mongoHost+mongoPort},
-			Timeout:  10 * time.Second,
-			Database: mongoDatabase, // It can be anything
-			Username: mongoUsername, // Username
-			Password: mongoPassword, // Password
-			DialServer: func(addr *mgo.ServerAddr) (net.Conn, error) {
-				return tls.Dial("tcp", addr.String(), &tls.Config{})
-			},
+func (s *MongoOrderStore) initMongoDial() (success bool, mErr error) {
+	var clientOptions *options.ClientOptions
+	if mongoURI != "" {
+		clientOptions, mErr = mongoURIClientOptions()
+		if mErr != nil {
+			printErr("MONGOURI is not a valid MongoDB connection string: ", mErr)
+			return
 		}
 	} else {
-		dialInfo = &mgo.DialInfo{
-			Addrs:    []string{mongoHost+mongoPort},
-			Timeout:  10 * time.Second,
-			Database: mongoDatabase, // It can be anything
-			Username: mongoUsername, // Username
-			Password: mongoPassword, // Password
-		}
+		clientOptions = mongoHostClientOptions()
 	}
 
-	// Create a mongoDBSession which maintains a pool of socket connections
+	// Create a mongoDBClient which maintains a pool of connections
 	// to our MongoDB.
 	success = false
 	//startTime := time.Now()
 
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
 	log.Println("Attempting to connect to MongoDB")
-	mongoDBSession, mongoDBSessionError = mgo.DialWithInfo(dialInfo)
-	if mongoDBSessionError != nil {
-		printErr(fmt.Sprintf("Can't connect to mongo at [%s], go error: ", mongoHost+mongoPort), mongoDBSessionError)
-		trackException(mongoDBSessionError)
-		mErr = mongoDBSessionError
+	s.mongoDBClient, mErr = mongo.Connect(ctx, clientOptions)
+	if mErr == nil {
+		// Connect doesn't wait for the server, so check it can be reached before taking orders
+		mErr = s.mongoDBClient.Ping(ctx, nil)
+	}
+	if mErr != nil {
+		printErr(fmt.Sprintf("Can't connect to mongo at [%s], go error: ", mongoAddress()), mErr)
+		trackException(mErr)
 	} else {
 		success = true
 		log.Println("\tConnected")
-
-		mongoDBSession.SetMode(mgo.Monotonic, true)
-		
-		// Limit connection pool to avoid running into Request Rate Too Large on CosmosDB
-		mongoDBSession.SetPoolLimit(mongoPoolLimit)
 	}
 
 
@@ -388,12 +589,12 @@ func initMongoDial() (success bool, mErr error) {
 				success)
 				dependency.Data = "Create session"
 
-			if mongoDBSessionError != nil {
-				dependency.ResultCode = mongoDBSessionError.Error()
+			if mErr != nil {
+				dependency.ResultCode = mErr.Error()
 			}
 
 			dependency.MarkTime(startTime, endTime)
-			CustomTelemetryClient.TrackException(mongoDBSessionError)
+			CustomTelemetryClient.TrackException(mErr)
 			CustomTelemetryClient.Track(dependency)
 		} else {
 			dependency := appinsights.NewRemoteDependencyTelemetry(
@@ -403,12 +604,12 @@ func initMongoDial() (success bool, mErr error) {
 				success)
 				dependency.Data = "Create session"
 
-			if mongoDBSessionError != nil {
-				dependency.ResultCode = mongoDBSessionError.Error()
+			if mErr != nil {
+				dependency.ResultCode = mErr.Error()
 			}
 
 			dependency.MarkTime(startTime, endTime)
-			CustomTelemetryClient.TrackException(mongoDBSessionError)
+			CustomTelemetryClient.TrackException(mErr)
 			CustomTelemetryClient.Track(dependency)
 		}
 	}
@@ -416,38 +617,161 @@ func initMongoDial() (success bool, mErr error) {
 	return
 }
 
+// mongoHostClientOptions configures the client from MONGOHOST, MONGOUSER and MONGOPASSWORD
+func mongoHostClientOptions() *options.ClientOptions {
+	if isCosmosDb {
+		log.Println("Using CosmosDB")
+		db = "CosmosDB"
+		mongoSSL = true
+		mongoPort = ":10255"
+
+	} else {
+		log.Println("Using MongoDB")
+		db = "MongoDB"
+		mongoSSL = false
+		mongoPort = ""
+	}
+
+	mongoDatabase := mongoDatabaseName // can be anything
+
+	log.Printf("\tUsername: %s", mongoUsername)
+	log.Printf("\tPassword set: %t", mongoPassword != "")
+	log.Printf("\tHost: %s", mongoHost)
+	log.Printf("\tPort: %s", mongoPort)
+	log.Printf("\tDatabase: %s", mongoDatabase)
+	log.Printf("\tSSL: %t", mongoSSL)
+
+	clientOptions := options.Client().
+		SetHosts([]string{mongoHost + mongoPort}).
+		SetConnectTimeout(10 * time.Second).
+		SetServerSelectionTimeout(10 * time.Second).
+		// Limit connection pool to avoid running into Request Rate Too Large on CosmosDB
+		SetMaxPoolSize(uint64(mongoPoolLimit))
+	if mongoUsername != "" {
+		clientOptions.SetAuth(options.Credential{
+			AuthSource: mongoDatabase, // It can be anything
+			Username:   mongoUsername, // Username
+			Password:   mongoPassword, // Password
+		})
+	}
+	if mongoSSL {
+		clientOptions.SetTLSConfig(&tls.Config{})
+	}
+	if isCosmosDb {
+		// CosmosDB doesn't support retryable writes
+		clientOptions.SetRetryWrites(false)
+	}
+
+	return clientOptions
+}
+
+// mongoURIClientOptions configures the client from the MONGOURI connection string. Hosts, replica set,
+// credentials, authSource, TLS and read preference all come from it, the pool limit and CosmosDB's
+// lack of retryable writes only apply when it doesn't set them.
+func mongoURIClientOptions() (*options.ClientOptions, error) {
+	if uriDatabase := mongoURIDatabase(mongoURI); uriDatabase != "" && os.Getenv("MONGODATABASE") == "" {
+		mongoDatabaseName = uriDatabase
+	}
+	if isCosmosDb {
+		log.Println("Using CosmosDB")
+		db = "CosmosDB"
+	} else {
+		log.Println("Using MongoDB")
+		db = "MongoDB"
+	}
+
+	log.Printf("\tURI: %s", redactMongoURI(mongoURI))
+	log.Printf("\tDatabase: %s", mongoDatabaseName)
+	log.Printf("\tCollection: %s", mongoCollectionName)
+
+	clientOptions := options.Client().ApplyURI(mongoURI)
+	if err := clientOptions.Validate(); err != nil {
+		return nil, err
+	}
+	if clientOptions.ConnectTimeout == nil {
+		clientOptions.SetConnectTimeout(10 * time.Second)
+	}
+	if clientOptions.ServerSelectionTimeout == nil {
+		clientOptions.SetServerSelectionTimeout(10 * time.Second)
+	}
+	if clientOptions.MaxPoolSize == nil {
+		// Limit connection pool to avoid running into Request Rate Too Large on CosmosDB
+		clientOptions.SetMaxPoolSize(uint64(mongoPoolLimit))
+	}
+	if isCosmosDb && clientOptions.RetryWrites == nil {
+		// CosmosDB doesn't support retryable writes
+		clientOptions.SetRetryWrites(false)
+	}
+	return clientOptions, nil
+}
+
+// mongoURIDatabase returns the database in the path of a connection string, if any
+func mongoURIDatabase(uri string) string {
+	if i := strings.Index(uri, "://"); i >= 0 {
+		uri = uri[i+3:]
+	}
+	i := strings.Index(uri, "/")
+	if i < 0 {
+		return ""
+	}
+	database := uri[i+1:]
+	if j := strings.Index(database, "?"); j >= 0 {
+		database = database[:j]
+	}
+	if unescaped, err := url.PathUnescape(database); err == nil {
+		database = unescaped
+	}
+	return database
+}
+
+// redactMongoURI hides the password in a connection string so it can be logged
+func redactMongoURI(uri string) string {
+	scheme := strings.Index(uri, "://")
+	at := strings.LastIndex(uri, "@")
+	if scheme < 0 || at < scheme {
+		return uri
+	}
+	userinfo := uri[scheme+3 : at]
+	if colon := strings.Index(userinfo, ":"); colon >= 0 {
+		userinfo = userinfo[:colon] + ":xxxxx"
+	}
+	return uri[:scheme+3] + userinfo + uri[at:]
+}
+
+// mongoAddress describes where MongoDB is for logs, without credentials
+func mongoAddress() string {
+	if mongoURI != "" {
+		return redactMongoURI(mongoURI)
+	}
+	return mongoHost + mongoPort
+}
+
 // Initialize the MongoDB client
-func initMongo() {
+func (s *MongoOrderStore) initMongo() error {
 
-	success, err := initMongoDial()
+	success, err := s.initMongoDial()
 	if !success {
-		os.Exit(1)
+		return err
 	}
 
-	mongoDBSessionCopy := mongoDBSession.Copy()
-	defer mongoDBSessionCopy.Close()
-
-	// SetSafe changes the mongoDBSessionCopy safety mode.
-	// If the safe parameter is nil, the mongoDBSessionCopy is put in unsafe mode, and writes become fire-and-forget,
-	// without error checking. The unsafe mode is faster since operations won't hold on waiting for a confirmation.
-	// http://godoc.org/labix.org/v2/mgo#Session.SetMode.
-	mongoDBSessionCopy.SetSafe(nil)
+	ctx, cancel := mongoContext()
+	defer cancel()
 
 	// Create a sharded collection and retrieve it
 	result := bson.M{}
-	err = mongoDBSessionCopy.DB(mongoDatabaseName).Run(
+	err = s.mongoDBClient.Database(mongoDatabaseName).RunCommand(ctx,
 		bson.D{
 			{
-				"shardCollection",
-				fmt.Sprintf("%s.%s", mongoDatabaseName, mongoCollectionName),
+				Key:   "shardCollection",
+				Value: fmt.Sprintf("%s.%s", mongoDatabaseName, mongoCollectionName),
 			},
 			{
-				"key",
-				bson.M{
+				Key: "key",
+				Value: bson.M{
 					mongoCollectionShardKey: "hashed",
 				},
 			},
-		}, &result)
+		}).Decode(&result)
 
 	if err != nil {
 		trackException(err)
@@ -457,178 +781,70 @@ func initMongo() {
 		log.Println("Created MongoDB collection: ")
 		log.Println(result)
 	}
+	return nil
 }
 
-// Initalize AMQP by figuring out where we are running
-func initAMQP() {
-	url, err := url.Parse(amqpURL)
+func trackException(err error) {
 	if err != nil {
-		// If the team provided an Application Insights key, let's track that exception
-		//if CustomTelemetryClient != nil {
-		//	CustomTelemetryClient.TrackException(err)
-		//}
-		log.Fatal(fmt.Sprintf("Problem parsing AMQP Host %s. Make sure you URL Encoded your policy/password.",url), err)
-	}
-
-
-	log.Println("Using Service Bus")
-
-	// Parse the eventHubName (last part of the url)
-	serivceBusName = url.Path
-	initAMQP10()
-	
-	log.Println("\tAMQP URL: " + amqpURL)
-	log.Println("** READY TO TAKE ORDERS **")
-}
-
-func initAMQP10() {		
-	// Try to establish the connection to AMQP
-	// with retry logic
-	err := try.Do(func(attempt int) (bool, error) {
-		var err error
-		
-		log.Println("Attempting to connect to ServiceBus")
-		amqp10Client, err = amqp10.Dial(amqpURL)
-		if err != nil {
-			trackException(err)
-		}
-
-		// Open a session if we managed to get an amqpClient
-		log.Println("\tConnected to Service Bus")	
-		if amqp10Client != nil {
-			log.Println("\tCreating a new AMQP session")
-			amqp10Session, err = amqp10Client.NewSession()	
-			if err != nil {
-				trackException(err)
-				log.Fatal("\t\tError creating AMQP session: ", err)
-			}
-		}
-
-		// Create a sender
-		log.Println("\tCreating AMQP sender")
-		amqpSender, err = amqp10Session.NewSender(
-			amqp10.LinkTargetAddress(serivceBusName),
-		)
-		if err != nil {
-			// If the team provided an Application Insights key, let's track that exception
-			//if CustomTelemetryClient != nil {
-			//	CustomTelemetryClient.TrackException(err)
-			//}
-			log.Fatal("\t\tError creating sender link: ", err)
+		printErr(err)
+		/*
+		if ChallengeTelemetryClient != nil {
+			ChallengeTelemetryClient.TrackException(err)
 		}
-
-		if err != nil {
-			printErr("Error connecting to Service Bus instance. Will retry in 5 seconds:", err)
-		  	time.Sleep(5 * time.Second) // wait
+		if CustomTelemetryClient != nil {
+			CustomTelemetryClient.TrackException(err)
 		}
-		return attempt < 3, err
-	  })
-	
-	  // If we still can't connect
-	if err != nil {
-		printErr("Couldn't connect to Service Bus after 3 retries:", err)
+		*/
 	}
 }
 
-// addOrderToAMQP10 Adds the order to AMQP 1.0 (sends to the Default ConsumerGroup)
-func addOrderToAMQP10(orderId string) bool {
-	var success bool
-	
-	if amqp10Client == nil {
-		log.Println("Skipping AMQP. It is either not configured or improperly configured")
-		success = true
-	} else {
-		// Only run this part if AMQP is configured
-		success = false
-		//var err error
-		//startTime := time.Now()
-		body := fmt.Sprintf("{\"order\": \"%s\", \"source\": \"%s\"}", orderId, teamName)
-
-		// Get an empty context
-		amqp10Context := context.Background()
-
-		log.Printf("AMQP URL: %s, Target: %s", amqpURL, serivceBusName)
-
-		// Prepare the context to timeout in 5 seconds
-		amqp10Context, cancel := context.WithTimeout(amqp10Context, 5*time.Second)
-
-		// Send with retry logic (in case we get a amqp.DetachError)
-		try.Do(func(attempt int) (bool, error) {
-			var err error
-
-			log.Println("Attempting to send the AMQP message: ", body)
-			err = amqpSender.Send(amqp10Context, amqp10.NewMessage([]byte(body)))
-			if err != nil {
-				success = false // this failed
-				switch t := err.(type) {
-				default:
-					printErr("Encountered an error sending AMQP. Will not retry: ", err)						
-					// If the team provided an Application Insights key, let's track that exception
-					trackException(err)
-					// This is an unhandled error, don't retry
-					return false, err
-				case *amqp10.DetachError:
-					printErr("Service Bus detached. Will reconnect and retry: " , t, err)
-					initAMQP10()
-			   }
-			} else {
-				success = true // finally succeeded
-			}
-			return attempt < 3, err
-		})
-
-		// Cancel the context and close the sender
-		cancel()
-		//sender.Close()
-		
-		//endTime := time.Now()
+// orders returns the orders collection
+func (s *MongoOrderStore) orders() *mongo.Collection {
+	return s.mongoDBClient.Database(mongoDatabaseName).Collection(mongoCollectionName)
+}
 
-		/*
-		if success {
-			// Track the event for the challenge purposes
-			eventTelemetry := appinsights.NewEventTelemetry("SendOrder to ServiceBus")
-			eventTelemetry.Properties["team"] = teamName
-			eventTelemetry.Properties["sequence"] = "2"
-			eventTelemetry.Properties["type"] = "servicebus"
-			eventTelemetry.Properties["service"] = "CaptureOrder"
-			eventTelemetry.Properties["orderId"] = orderId
-			ChallengeTelemetryClient.Track(eventTelemetry)
-		}
+// mongoContext bounds a single MongoDB operation by mongoTimeout
+func mongoContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), mongoTimeout)
+}
 
-		// Track the dependency, if the team provided an Application Insights key, let's track that dependency
-		if CustomTelemetryClient != nil {
-			dependency := appinsights.NewRemoteDependencyTelemetry(
-				"ServiceBus",
-				"AMQP",
-				amqpURL,
-				success)
-			dependency.Data = "Send message"
+// pageSize clamps a requested page size to the allowed range
+func pageSize(limit int) int {
+	if limit <= 0 {
+		return DefaultOrderPageSize
+	} else if limit > MaxOrderPageSize {
+		return MaxOrderPageSize
+	}
+	return limit
+}
 
-			if err != nil {
-				dependency.ResultCode = err.Error()
-			}
+// prepareNewOrder assigns the server managed fields of an order about to be inserted
+func prepareNewOrder(order *Order) {
+	order.ID = primitive.NewObjectID()
+	order.EmailAddressNormalized = NormalizeEmailAddress(order.EmailAddress)
+	PriceOrder(order)
+	order.Status = StatusOpen
+	order.CreatedAt = time.Now().UTC()
+	order.StatusHistory = []StatusTransition{{To: StatusOpen, At: order.CreatedAt}}
+	order.Version = 1
+}
 
-			dependency.MarkTime(startTime, endTime)
-			CustomTelemetryClient.Track(dependency)
-		}
-		*/
-		log.Printf("Sent to AMQP 1.0 (ServiceBus) - %t, %s: %s", success, amqpURL, body)
-	}
-	return success
+// encodeOrderCursor turns the last _id of a page into an opaque cursor
+func encodeOrderCursor(id primitive.ObjectID) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id.Hex()))
 }
 
-func trackException(err error) {
+// decodeOrderCursor is the inverse of encodeOrderCursor
+func decodeOrderCursor(cursor string) (primitive.ObjectID, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
 	if err != nil {
-		printErr(err)
-		/*
-		if ChallengeTelemetryClient != nil {
-			ChallengeTelemetryClient.TrackException(err)
-		}
-		if CustomTelemetryClient != nil {
-			CustomTelemetryClient.TrackException(err)
-		}
-		*/
+		return primitive.NilObjectID, ErrInvalidCursor
+	}
+	id, err := primitive.ObjectIDFromHex(string(b))
+	if err != nil {
+		return primitive.NilObjectID, ErrInvalidCursor
 	}
+	return id, nil
 }
 
 // random: Generates a random number
@@ -638,7 +854,7 @@ func random(min int, max int) int {
 
 func printErr(v ...interface{}) {
 	log.SetOutput(os.Stderr)
-	log.Println(v);
+	log.Println(v...)
 	log.SetOutput(os.Stdout)
 }
 
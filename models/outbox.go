@@ -0,0 +1,289 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OutboxMessage is an event waiting in the outbox. The stores write it in the same
+// transaction as the order it announces, so an order is never stored without it.
+// MongoDB/CosmosDB keeps it in the order document instead, see mongoOrderDocument.
+type OutboxMessage struct {
+	ID            primitive.ObjectID `bson:"_id"`
+	OrderID       string             `bson:"orderId"`
+	Body          string             `bson:"body"`
+	CreatedAt     time.Time          `bson:"createdAt"`
+	Attempts      int                `bson:"attempts"`      // failed attempts so far
+	NextAttemptAt time.Time          `bson:"nextAttemptAt"` // not sent before this time
+	LastError     string             `bson:"lastError,omitempty"`
+	DeliveredAt   *time.Time         `bson:"deliveredAt,omitempty"` // nil until the broker acknowledged it
+}
+
+// Outbox gives the OutboxRelay the messages stored along with the orders
+type Outbox interface {
+	// ClaimOutboxMessages returns up to limit undelivered messages that are due and pushes their
+	// next attempt back by lease, so that other relays leave them alone while they are sent.
+	ClaimOutboxMessages(limit int, lease time.Duration) ([]OutboxMessage, error)
+
+	// MarkOutboxMessageDelivered records that the broker acknowledged a claimed message
+	MarkOutboxMessageDelivered(message OutboxMessage) error
+
+	// RetryOutboxMessage records a failed attempt to send a claimed message and when to try again
+	RetryOutboxMessage(message OutboxMessage, nextAttemptAt time.Time, lastError string) error
+}
+
+// The collection MongoDB/CosmosDB kept the outbox in before it moved into the order documents
+var legacyOutboxCollectionName = "outbox"
+
+// How often the relay looks for pending messages. Override with the OUTBOX_POLL_INTERVAL environment variable, e.g. 500ms
+var outboxPollInterval = 2 * time.Second
+
+// Outbox relay tuning
+const (
+	outboxBatchSize  = 50
+	outboxLease      = time.Minute // longer than AMQPPublisher.Publish takes, it doesn't wait for Service Bus to reconnect
+	outboxMaxBackoff = 5 * time.Minute
+)
+
+// newOutboxMessage returns the message with an event of the given type about order, due at.
+// Its body is the CloudEvent in structured mode, identified by the message ID.
+func newOutboxMessage(eventType string, order Order, at time.Time) OutboxMessage {
+	id := primitive.NewObjectID()
+	body, _ := json.Marshal(newOrderEvent(eventType, id, order, at))
+	return OutboxMessage{
+		ID:            id,
+		OrderID:       order.ID.Hex(),
+		Body:          string(body),
+		CreatedAt:     at,
+		NextAttemptAt: at,
+	}
+}
+
+// newOrderAddedOutboxMessage returns the message announcing a new order, due right away
+func newOrderAddedOutboxMessage(order Order) OutboxMessage {
+	return newOutboxMessage(OrderCreatedEventType, order, order.CreatedAt)
+}
+
+// newOrderCancelledOutboxMessage returns the message telling fulfillment to stop work on a cancelled order
+func newOrderCancelledOutboxMessage(order Order) OutboxMessage {
+	return newOutboxMessage(OrderCancelledEventType, order, order.Cancellation.At)
+}
+
+// outboxBackoff is how long to wait after the given number of failed attempts
+func outboxBackoff(attempts int) time.Duration {
+	backoff := time.Second
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outboxMaxBackoff {
+		return outboxMaxBackoff
+	}
+	return backoff
+}
+
+// OutboxRelay publishes the messages in the outbox, retrying those
+// that aren't acknowledged with an exponential backoff.
+type OutboxRelay struct {
+	outbox    Outbox
+	publisher OrderPublisher
+}
+
+// NewOutboxRelay returns a relay publishing the messages of outbox with publisher
+func NewOutboxRelay(outbox Outbox, publisher OrderPublisher) *OutboxRelay {
+	return &OutboxRelay{outbox: outbox, publisher: publisher}
+}
+
+// Start relays pending messages in the background every outboxPollInterval
+func (r *OutboxRelay) Start() {
+	log.Printf("Relaying the outbox every %v", outboxPollInterval)
+	go func() {
+		for {
+			// Keep going without waiting while there are more messages than fit in one batch
+			if r.RelayPending() < outboxBatchSize {
+				time.Sleep(outboxPollInterval)
+			}
+		}
+	}()
+}
+
+// RelayPending sends one batch of due messages and returns how many it claimed
+func (r *OutboxRelay) RelayPending() int {
+	messages, err := r.outbox.ClaimOutboxMessages(outboxBatchSize, outboxLease)
+	if err != nil {
+		printErr("Problem claiming outbox messages: ", err)
+		return 0
+	}
+
+	for _, message := range messages {
+		if r.publisher.Publish(decodeOutboxEvent(message)) {
+			if err := r.outbox.MarkOutboxMessageDelivered(message); err != nil {
+				// The message stays claimed until the lease expires and is then sent again
+				printErr("Problem marking outbox message delivered: ", err)
+			}
+			continue
+		}
+
+		attempts := message.Attempts + 1
+		nextAttemptAt := time.Now().UTC().Add(outboxBackoff(attempts))
+		log.Printf("Order %s wasn't published after %d attempts, retrying at %s", message.OrderID, attempts, nextAttemptAt.Format(time.RFC3339))
+		if err := r.outbox.RetryOutboxMessage(message, nextAttemptAt, fmt.Sprintf("not acknowledged on attempt %d", attempts)); err != nil {
+			printErr("Problem rescheduling outbox message: ", err)
+		}
+	}
+	return len(messages)
+}
+
+// mongoOrderDocument is an order as inserted into MongoDB/CosmosDB, with the outbox messages
+// still to be sent embedded in it. Writing both in one document makes the write atomic without
+// a transaction, which a standalone server doesn't support and CosmosDB only supports within an
+// unsharded collection. Orders are read without the outbox field, it is only used by the relay.
+type mongoOrderDocument struct {
+	Order  `bson:",inline"`
+	Outbox []OutboxMessage `bson:"outbox,omitempty"`
+}
+
+// newMongoOrderDocument returns the document of a new order along with the message announcing it
+func newMongoOrderDocument(order Order) mongoOrderDocument {
+	return mongoOrderDocument{Order: order, Outbox: []OutboxMessage{newOrderAddedOutboxMessage(order)}}
+}
+
+// ClaimOutboxMessages claims due messages embedded in the orders in MongoDB/CosmosDB, see Outbox.
+// Each message is claimed by moving its next attempt only if no other relay moved it first.
+func (s *MongoOrderStore) ClaimOutboxMessages(limit int, lease time.Duration) ([]OutboxMessage, error) {
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	now := time.Now().UTC()
+	var pending []mongoOrderDocument
+	err := retryThrottled(ctx, "find outbox messages", func() error {
+		cursor, err := s.orders().Find(ctx,
+			bson.M{"outbox.nextAttemptAt": bson.M{"$lte": now}},
+			options.Find().SetProjection(bson.M{"outbox": 1}).SetLimit(int64(limit)))
+		if err == nil {
+			err = cursor.All(ctx, &pending)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []OutboxMessage{}
+	for _, doc := range pending {
+		for _, message := range doc.Outbox {
+			if len(messages) == limit {
+				return messages, nil
+			}
+			if message.NextAttemptAt.After(now) {
+				continue
+			}
+			var result *mongo.UpdateResult
+			err := retryThrottled(ctx, "claim outbox message", func() error {
+				var err error
+				result, err = s.orders().UpdateOne(ctx,
+					bson.M{"_id": doc.ID, "outbox": bson.M{"$elemMatch": bson.M{"_id": message.ID, "nextAttemptAt": message.NextAttemptAt}}},
+					bson.M{"$set": bson.M{"outbox.$.nextAttemptAt": now.Add(lease)}})
+				return err
+			})
+			if err != nil {
+				return messages, err
+			}
+			if result.ModifiedCount == 1 {
+				messages = append(messages, message)
+			}
+		}
+	}
+	return messages, nil
+}
+
+// MarkOutboxMessageDelivered removes a delivered message from its order in MongoDB/CosmosDB
+func (s *MongoOrderStore) MarkOutboxMessageDelivered(message OutboxMessage) error {
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	orderID, err := primitive.ObjectIDFromHex(message.OrderID)
+	if err != nil {
+		return err
+	}
+	return retryThrottled(ctx, "mark outbox message delivered", func() error {
+		_, err := s.orders().UpdateByID(ctx, orderID, bson.M{"$pull": bson.M{"outbox": bson.M{"_id": message.ID}}})
+		return err
+	})
+}
+
+// RetryOutboxMessage records a failed attempt to send a message in its order in MongoDB/CosmosDB
+func (s *MongoOrderStore) RetryOutboxMessage(message OutboxMessage, nextAttemptAt time.Time, lastError string) error {
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	orderID, err := primitive.ObjectIDFromHex(message.OrderID)
+	if err != nil {
+		return err
+	}
+	return retryThrottled(ctx, "reschedule outbox message", func() error {
+		_, err := s.orders().UpdateOne(ctx,
+			bson.M{"_id": orderID, "outbox._id": message.ID},
+			bson.M{
+				"$set": bson.M{"outbox.$.nextAttemptAt": nextAttemptAt, "outbox.$.lastError": lastError},
+				"$inc": bson.M{"outbox.$.attempts": 1},
+			})
+		return err
+	})
+}
+
+// initOutboxPollInterval reads how often the outbox relay looks for pending messages
+func initOutboxPollInterval() {
+	if interval := os.Getenv("OUTBOX_POLL_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil && d > 0 {
+			outboxPollInterval = d
+		} else {
+			printErr("Ignoring invalid OUTBOX_POLL_INTERVAL: ", interval)
+		}
+	}
+	log.Printf("Outbox poll interval set to %v. You can override by setting the OUTBOX_POLL_INTERVAL environment variable.", outboxPollInterval)
+}
+
+// initOutbox moves the messages still pending in the outbox collection, where they were kept before,
+// into their orders so the relay sends them. Messages already moved by another instance aren't added twice.
+func (s *MongoOrderStore) initOutbox() {
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	var messages []OutboxMessage
+	cursor, err := s.legacyOutbox().Find(ctx, bson.M{"deliveredAt": bson.M{"$exists": false}})
+	if err == nil {
+		err = cursor.All(ctx, &messages)
+	}
+	for i := 0; err == nil && i < len(messages); i++ {
+		message := messages[i]
+		var orderID primitive.ObjectID
+		if orderID, err = primitive.ObjectIDFromHex(message.OrderID); err != nil {
+			break
+		}
+		_, err = s.orders().UpdateOne(ctx,
+			bson.M{"_id": orderID, "outbox._id": bson.M{"$ne": message.ID}},
+			bson.M{"$push": bson.M{"outbox": message}})
+		if err == nil {
+			_, err = s.legacyOutbox().DeleteOne(ctx, bson.M{"_id": message.ID})
+		}
+	}
+	if err != nil {
+		trackException(err)
+		printErr("Could not move the pending messages of the outbox collection into their orders, they won't be sent: ", err)
+	} else if len(messages) > 0 {
+		log.Println("Moved", len(messages), "pending messages of the outbox collection into their orders")
+	}
+}
+
+// legacyOutbox returns the outbox collection used before the outbox moved into the order documents
+func (s *MongoOrderStore) legacyOutbox() *mongo.Collection {
+	return s.mongoDBClient.Database(mongoDatabaseName).Collection(legacyOutboxCollectionName)
+}
@@ -0,0 +1,113 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// recordingPublisher records the events it is asked to publish
+type recordingPublisher struct {
+	sent        []CloudEvent
+	acknowledge bool
+}
+
+func (p *recordingPublisher) Publish(event CloudEvent) bool {
+	p.sent = append(p.sent, event)
+	return p.acknowledge
+}
+
+func TestOutboxRelay(t *testing.T) {
+	store := NewMemoryOrderStore()
+	first, _ := store.Create(newTestOrder("jane@example.com", "sku-1"))
+	store.CreateMany([]Order{newTestOrder("jane@example.com", "sku-2"), newTestOrder("john@example.com", "sku-1")})
+
+	publisher := &recordingPublisher{}
+	relay := NewOutboxRelay(store, publisher)
+
+	// Unacknowledged messages are kept and retried later
+	if claimed := relay.RelayPending(); claimed != 3 || len(publisher.sent) != 3 {
+		t.Fatalf("RelayPending claimed %d and sent %d messages, expected 3", claimed, len(publisher.sent))
+	}
+	if event := publisher.sent[0]; event.Type != OrderCreatedEventType || event.Subject != first.ID.Hex() || event.DataSchema != orderEventDataSchema {
+		t.Errorf("The first event sent was %+v", event)
+	}
+	// Retries send the same event
+	firstEventID := publisher.sent[0].ID
+	if claimed := relay.RelayPending(); claimed != 0 {
+		t.Errorf("RelayPending claimed %d messages before their retry was due", claimed)
+	}
+	for id, message := range store.outbox {
+		if message.Attempts != 1 || message.LastError == "" {
+			t.Errorf("Message %s wasn't rescheduled: %+v", id.Hex(), message)
+		}
+		message.NextAttemptAt = time.Now().UTC()
+		store.outbox[id] = message
+	}
+
+	publisher.acknowledge = true
+	if claimed := relay.RelayPending(); claimed != 3 {
+		t.Fatalf("RelayPending claimed %d messages on retry, expected 3", claimed)
+	}
+	retried := false
+	for _, event := range publisher.sent[3:] {
+		retried = retried || event.ID == firstEventID
+	}
+	if !retried {
+		t.Errorf("The event %s wasn't sent again with the same ID", firstEventID)
+	}
+	if len(store.outbox) != 0 {
+		t.Errorf("%d messages are left after they were delivered", len(store.outbox))
+	}
+}
+
+func TestOutboxClaimLease(t *testing.T) {
+	store := NewMemoryOrderStore()
+	store.Create(newTestOrder("jane@example.com", "sku-1"))
+
+	messages, _ := store.ClaimOutboxMessages(10, time.Minute)
+	if len(messages) != 1 {
+		t.Fatalf("ClaimOutboxMessages returned %d messages, expected 1", len(messages))
+	}
+	if again, _ := store.ClaimOutboxMessages(10, time.Minute); len(again) != 0 {
+		t.Errorf("A claimed message was claimed again: %+v", again)
+	}
+}
+
+func TestMongoOrderDocument(t *testing.T) {
+	order := newTestOrder("jane@example.com", "sku-1")
+	prepareNewOrder(&order)
+	raw, err := bson.Marshal(newMongoOrderDocument(order))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The order fields are at the top level, as the queries on orders expect
+	var fields bson.M
+	bson.Unmarshal(raw, &fields)
+	if fields["_id"] != order.ID || fields["status"] != string(StatusOpen) {
+		t.Errorf("The order fields aren't at the top level of %v", fields)
+	}
+
+	var doc mongoOrderDocument
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Outbox) != 1 || doc.Outbox[0].OrderID != order.ID.Hex() || doc.Outbox[0].NextAttemptAt.After(time.Now()) {
+		t.Errorf("The order document has the outbox %+v, expected the due message announcing it", doc.Outbox)
+	}
+	// Orders are read as they were before the outbox moved into them
+	var stored Order
+	if err := bson.Unmarshal(raw, &stored); err != nil || stored.ID != order.ID {
+		t.Errorf("The order document was read as %+v, %v", stored, err)
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	for attempts, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 30: outboxMaxBackoff} {
+		if backoff := outboxBackoff(attempts); backoff != expected {
+			t.Errorf("outboxBackoff(%d) returned %v, expected %v", attempts, backoff, expected)
+		}
+	}
+}
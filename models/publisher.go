@@ -0,0 +1,355 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/matryer/try.v1"
+	amqp10 "pack.ag/amqp"
+)
+
+// OrderPublisher sends the messages about orders to fulfillment
+type OrderPublisher interface {
+	// Publish sends an event about an order and reports whether it was acknowledged.
+	// Events that weren't are retried by the OutboxRelay.
+	Publish(event CloudEvent) bool
+}
+
+// Which OrderPublisher is used: amqp, kafka, log or none. Defaults to amqp when AMQPURL is set and none otherwise.
+var orderPublisherBackend = os.Getenv("ORDERPUBLISHER")
+
+// NewOrderPublisher returns the OrderPublisher selected by the ORDERPUBLISHER environment variable.
+// When SPOOL_DIR is set, the messages the broker doesn't take are spooled there and sent in the background.
+func NewOrderPublisher() (OrderPublisher, error) {
+	backend := orderPublisherBackend
+	if backend == "" {
+		backend = "none"
+		if amqpURL != "" {
+			backend = "amqp"
+		}
+	}
+
+	publisher, err := newBrokerPublisher(backend)
+	if err != nil || spoolDir == "" || backend == "none" {
+		return publisher, err
+	}
+
+	spool, err := OpenSpool(spoolDir, spoolSegmentSize)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open the spool in %s: %v", spoolDir, err)
+	}
+	log.Printf("Spooling the order messages the broker doesn't take in %s. You can override by setting the SPOOL_DIR environment variable.", spoolDir)
+	activeSpool = spool
+	spooling := NewSpoolingPublisher(publisher, spool)
+	spooling.Start()
+	return spooling, nil
+}
+
+// newBrokerPublisher returns the OrderPublisher of a backend
+func newBrokerPublisher(backend string) (OrderPublisher, error) {
+	switch backend {
+	case "amqp":
+		if amqpURL == "" {
+			return nil, fmt.Errorf("ORDERPUBLISHER=amqp needs the AMQPURL environment variable")
+		}
+		return NewAMQPPublisher(amqpURL)
+	case "kafka":
+		return NewKafkaPublisher()
+	case "log":
+		log.Println("Logging order messages instead of publishing them")
+		return LogPublisher{}, nil
+	case "none":
+		log.Println("Order messages are not published. Set AMQPURL or ORDERPUBLISHER to publish them.")
+		return NoopPublisher{}, nil
+	default:
+		return nil, fmt.Errorf("unknown ORDERPUBLISHER %q, use amqp, kafka, log or none", backend)
+	}
+}
+
+// NoopPublisher drops every message, for when publishing is disabled.
+// Messages are acknowledged so the outbox doesn't keep them.
+type NoopPublisher struct{}
+
+func (NoopPublisher) Publish(event CloudEvent) bool {
+	return true
+}
+
+// LogPublisher logs every message instead of sending it, to see what would be published
+type LogPublisher struct{}
+
+func (LogPublisher) Publish(event CloudEvent) bool {
+	body, _ := json.Marshal(event)
+	log.Println("Publishing order event:", string(body))
+	return true
+}
+
+// AMQPPublisher sends messages to a Service Bus queue over AMQP 1.0
+type AMQPPublisher struct {
+	url    string
+	target string // the queue, which is the path of the URL
+
+	mu           sync.Mutex // guards the connection, which is replaced when Service Bus detaches
+	client       *amqp10.Client
+	session      *amqp10.Session
+	sender       *amqp10.Sender
+	reconnecting bool // a background reconnect is running
+}
+
+// NewAMQPPublisher returns a publisher sending to the Service Bus queue at amqpURL. If it can't connect
+// yet it connects again in the background on the first Publish.
+func NewAMQPPublisher(amqpURL string) (*AMQPPublisher, error) {
+	u, err := url.Parse(amqpURL)
+	if err != nil {
+		return nil, fmt.Errorf("problem parsing AMQP URL, make sure you URL encoded your policy/password: %v", err)
+	}
+
+	log.Println("Using Service Bus")
+	p := &AMQPPublisher{url: amqpURL, target: u.Path}
+	if err := p.connect(); err != nil {
+		printErr("Couldn't connect to Service Bus after 3 retries:", err)
+	}
+
+	log.Println("\tAMQP target: " + p.target)
+	log.Println("** READY TO TAKE ORDERS **")
+	return p, nil
+}
+
+// Publish sends the event to the queue. While it isn't connected, or when Service Bus detached, it returns
+// false right away and reconnects in the background, the outbox relay sends the event again after its backoff.
+func (p *AMQPPublisher) Publish(event CloudEvent) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.sender == nil {
+		log.Printf("Not connected to Service Bus, %s event %s will be retried", event.Type, event.ID)
+		p.reconnect()
+		return false
+	}
+
+	// Prepare the context to timeout in 5 seconds
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	log.Printf("Attempting to send the AMQP message for %s event %s", event.Type, event.ID)
+	err := p.sender.Send(ctx, amqpMessage(event))
+	success := err == nil
+	if _, detached := err.(*amqp10.DetachError); detached {
+		printErr("Service Bus detached. Will reconnect and retry later: ", err)
+		p.reconnect()
+	} else if err != nil {
+		printErr("Encountered an error sending AMQP. Will retry later: ", err)
+		trackException(err)
+	}
+
+	log.Printf("Sent to AMQP 1.0 (ServiceBus) - %t, %s: %s event %s for order %s", success, p.target, event.Type, event.ID, event.Subject)
+	return success
+}
+
+// What is set on AMQP messages besides the event, including the application properties sent.
+// Override with the AMQP_MESSAGE_ID, AMQP_TTL, AMQP_SUBJECTS and AMQP_APPLICATION_PROPERTIES environment variables.
+var (
+	amqpMessageIDMode = getEnv("AMQP_MESSAGE_ID", "order") // order or event
+	amqpTTL           time.Duration                        // zero leaves it to the queue
+	amqpSubjects      = map[string]string{}                // by event type, the type itself when missing
+	amqpProperties    = []string{"team", "status", "schemaVersion"}
+)
+
+// amqpApplicationProperties are the application properties AMQP_APPLICATION_PROPERTIES can pick from
+var amqpApplicationProperties = map[string]bool{"team": true, "status": true, "schemaVersion": true}
+
+// amqpMessage puts an event in an AMQP message following the CloudEvents AMQP binding, in the
+// mode set by CLOUDEVENTS_MODE. The message properties Service Bus uses are set too: the message
+// ID for duplicate detection, the correlation ID of the request, the subject as the label and the TTL.
+// Messages are always durable so that the broker doesn't lose them.
+func amqpMessage(event CloudEvent) *amqp10.Message {
+	var message *amqp10.Message
+	if !binaryMode() {
+		body, _ := json.Marshal(event)
+		message = amqp10.NewMessage(body)
+		message.Properties = &amqp10.MessageProperties{ContentType: cloudEventsContentType}
+		message.ApplicationProperties = map[string]interface{}{}
+	} else {
+		message = amqp10.NewMessage(event.Data)
+		message.Properties = &amqp10.MessageProperties{ContentType: event.DataContentType}
+		message.ApplicationProperties = map[string]interface{}{}
+		for name, value := range cloudEventAttributes(event) {
+			message.ApplicationProperties["cloudEvents_"+name] = value
+		}
+	}
+
+	message.Properties.MessageID = amqpMessageID(event)
+	message.Properties.Subject = amqpSubject(event.Type)
+	message.Properties.CreationTime = event.Time
+	if event.CorrelationID != "" {
+		message.Properties.CorrelationID = event.CorrelationID
+	}
+	message.Header = &amqp10.MessageHeader{Durable: true}
+	if amqpTTL > 0 {
+		message.Header.TTL = amqpTTL
+	}
+	for name, value := range amqpPropertyValues(event) {
+		message.ApplicationProperties[name] = value
+	}
+	return message
+}
+
+// amqpMessageID identifies the message for Service Bus duplicate detection. With AMQP_MESSAGE_ID=order
+// the created message of an order is identified by the order ID and its other messages by the order
+// ID and the event, so every instance sends the same ID for the same change. With AMQP_MESSAGE_ID=event
+// it is the event ID, which only retries of the same event share.
+func amqpMessageID(event CloudEvent) string {
+	if amqpMessageIDMode == "event" || event.Subject == "" {
+		return event.ID
+	}
+	if event.Type == OrderCreatedEventType {
+		return event.Subject
+	}
+	return event.Subject + "/" + strings.TrimPrefix(event.Type, "com.microsoft.captureorder.order.")
+}
+
+// amqpSubject returns the subject, shown as the label by Service Bus, of the messages of an event type
+func amqpSubject(eventType string) string {
+	if subject, ok := amqpSubjects[eventType]; ok {
+		return subject
+	}
+	return eventType
+}
+
+// amqpPropertyValues returns the application properties picked by AMQP_APPLICATION_PROPERTIES
+// that have a value for the event, so subscriptions can filter on them
+func amqpPropertyValues(event CloudEvent) map[string]interface{} {
+	values := map[string]interface{}{}
+	for _, name := range amqpProperties {
+		switch name {
+		case "team":
+			if teamName != "" {
+				values[name] = teamName
+			}
+		case "status":
+			var order struct {
+				Status string `json:"status"`
+			}
+			if json.Unmarshal(event.Data, &order) == nil && order.Status != "" {
+				values[name] = order.Status
+			}
+		case "schemaVersion":
+			if event.DataSchema != "" {
+				values[name] = event.DataSchema
+			}
+		}
+	}
+	return values
+}
+
+// initAMQPMessages reads what is set on AMQP messages
+func initAMQPMessages() {
+	if amqpMessageIDMode != "order" && amqpMessageIDMode != "event" {
+		printErr("Ignoring invalid AMQP_MESSAGE_ID: ", amqpMessageIDMode)
+		amqpMessageIDMode = "order"
+	}
+	if ttl := os.Getenv("AMQP_TTL"); ttl != "" {
+		if d, err := time.ParseDuration(ttl); err == nil && d > 0 {
+			amqpTTL = d
+		} else {
+			printErr("Ignoring invalid AMQP_TTL: ", ttl)
+		}
+	}
+	if subjects := os.Getenv("AMQP_SUBJECTS"); subjects != "" {
+		for _, pair := range strings.Split(subjects, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+				printErr("Ignoring invalid AMQP_SUBJECTS entry: ", pair)
+				continue
+			}
+			amqpSubjects[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	if properties, ok := os.LookupEnv("AMQP_APPLICATION_PROPERTIES"); ok {
+		amqpProperties = nil
+		for _, name := range strings.Split(properties, ",") {
+			name = strings.TrimSpace(name)
+			if amqpApplicationProperties[name] {
+				amqpProperties = append(amqpProperties, name)
+			} else if name != "" && name != "none" {
+				printErr("Ignoring unknown AMQP_APPLICATION_PROPERTIES entry: ", name)
+			}
+		}
+	}
+	log.Printf("AMQP messages are identified by the %s ID and carry the application properties %v. You can override by setting the AMQP_MESSAGE_ID, AMQP_TTL, AMQP_SUBJECTS and AMQP_APPLICATION_PROPERTIES environment variables.",
+		amqpMessageIDMode, amqpProperties)
+}
+
+// reconnect drops the connection and connects again in the background, unless that is already
+// under way, so that publishing never waits for Service Bus. The caller must hold the lock.
+func (p *AMQPPublisher) reconnect() {
+	if p.reconnecting {
+		return
+	}
+	p.reconnecting = true
+	client := p.client
+	p.client, p.session, p.sender = nil, nil, nil
+
+	go func() {
+		if client != nil {
+			client.Close()
+		}
+		if err := p.connect(); err != nil {
+			printErr("Couldn't reconnect to Service Bus after 3 retries, will try again on the next publish: ", err)
+		}
+		p.mu.Lock()
+		p.reconnecting = false
+		p.mu.Unlock()
+	}()
+}
+
+// connect opens the connection, session and sender, retrying 3 times. It waits between the attempts,
+// so the caller must not hold the lock.
+func (p *AMQPPublisher) connect() error {
+	return try.Do(func(attempt int) (bool, error) {
+		log.Println("Attempting to connect to ServiceBus")
+		client, session, sender, err := p.dial()
+		if err != nil {
+			trackException(err)
+			printErr("Error connecting to Service Bus instance. Will retry in 5 seconds:", err)
+			time.Sleep(5 * time.Second)
+			return attempt < 3, err
+		}
+
+		p.mu.Lock()
+		p.client, p.session, p.sender = client, session, sender
+		p.mu.Unlock()
+		return false, nil
+	})
+}
+
+// dial opens a new connection, session and sender
+func (p *AMQPPublisher) dial() (*amqp10.Client, *amqp10.Session, *amqp10.Sender, error) {
+	client, err := amqp10.Dial(p.url)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	log.Println("\tConnected to Service Bus")
+
+	log.Println("\tCreating a new AMQP session")
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, nil, nil, err
+	}
+
+	log.Println("\tCreating AMQP sender")
+	sender, err := session.NewSender(amqp10.LinkTargetAddress(p.target))
+	if err != nil {
+		client.Close()
+		return nil, nil, nil, err
+	}
+
+	return client, session, sender, nil
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNewOrderPublisher(t *testing.T) {
+	defer func(backend, url, brokers string) {
+		orderPublisherBackend, amqpURL, kafkaBrokers = backend, url, brokers
+	}(orderPublisherBackend, amqpURL, kafkaBrokers)
+	amqpURL, kafkaBrokers = "", ""
+
+	for backend, expected := range map[string]OrderPublisher{"": NoopPublisher{}, "none": NoopPublisher{}, "log": LogPublisher{}} {
+		orderPublisherBackend = backend
+		if publisher, err := NewOrderPublisher(); err != nil || publisher != expected {
+			t.Errorf("NewOrderPublisher for ORDERPUBLISHER=%q returned %T, %v", backend, publisher, err)
+		}
+	}
+
+	orderPublisherBackend = "amqp"
+	if _, err := NewOrderPublisher(); err == nil {
+		t.Error("NewOrderPublisher returned an AMQP publisher without AMQPURL")
+	}
+	orderPublisherBackend = "kafka"
+	if _, err := NewOrderPublisher(); err == nil {
+		t.Error("NewOrderPublisher returned a Kafka publisher without KAFKA_BROKERS")
+	}
+	orderPublisherBackend = "rabbitmq"
+	if _, err := NewOrderPublisher(); err == nil {
+		t.Error("NewOrderPublisher accepted an unknown publisher")
+	}
+}
+
+func TestAMQPMessageProperties(t *testing.T) {
+	defer func(mode, team string, ttl time.Duration, subjects map[string]string, properties []string) {
+		amqpMessageIDMode, teamName, amqpTTL, amqpSubjects, amqpProperties = mode, team, ttl, subjects, properties
+	}(amqpMessageIDMode, teamName, amqpTTL, amqpSubjects, amqpProperties)
+	teamName = "team-1"
+
+	order := newTestOrder("jane@example.com", "sku-1")
+	prepareNewOrder(&order)
+	order.CorrelationID = "request-1"
+	created := newOrderEvent(OrderCreatedEventType, primitive.NewObjectID(), order, order.CreatedAt)
+	order.Status = StatusCancelled
+	cancelled := newOrderEvent(OrderCancelledEventType, primitive.NewObjectID(), order, time.Now())
+
+	// By default messages are identified by order and carry every application property
+	message := amqpMessage(created)
+	if message.Properties.MessageID != order.ID.Hex() || message.Properties.CorrelationID != "request-1" || message.Properties.Subject != OrderCreatedEventType {
+		t.Errorf("The created message has the properties %+v", message.Properties)
+	}
+	if message.Header == nil || !message.Header.Durable || message.Header.TTL != 0 {
+		t.Errorf("The created message has the header %+v, expected a durable message without AMQP_TTL", message.Header)
+	}
+	if p := message.ApplicationProperties; p["team"] != "team-1" || p["status"] != StatusOpen || p["schemaVersion"] != orderEventDataSchema {
+		t.Errorf("The created message has the application properties %v", p)
+	}
+	message = amqpMessage(cancelled)
+	if message.Properties.MessageID != order.ID.Hex()+"/cancelled" || message.ApplicationProperties["status"] != StatusCancelled {
+		t.Errorf("The cancelled message has the ID %v and application properties %v", message.Properties.MessageID, message.ApplicationProperties)
+	}
+
+	amqpMessageIDMode = "event"
+	amqpTTL = time.Hour
+	amqpSubjects = map[string]string{OrderCancelledEventType: "OrderCancelled"}
+	amqpProperties = []string{"status"}
+	message = amqpMessage(cancelled)
+	if message.Properties.MessageID != cancelled.ID || message.Properties.Subject != "OrderCancelled" {
+		t.Errorf("The cancelled message has the properties %+v", message.Properties)
+	}
+	if message.Header == nil || !message.Header.Durable || message.Header.TTL != time.Hour {
+		t.Errorf("The cancelled message has the header %+v, expected a durable message with a TTL of an hour", message.Header)
+	}
+	if len(message.ApplicationProperties) != 1 || message.ApplicationProperties["status"] != StatusCancelled {
+		t.Errorf("The cancelled message has the application properties %v, expected only the status", message.ApplicationProperties)
+	}
+}
+
+func TestKafkaProducerConfig(t *testing.T) {
+	config, err := kafkaProducerConfig("all", true)
+	if err != nil || config.Producer.RequiredAcks != sarama.WaitForAll || !config.Producer.Idempotent || config.Net.MaxOpenRequests != 1 {
+		t.Errorf("kafkaProducerConfig for an idempotent producer returned %+v, %v", config, err)
+	}
+	if config, err := kafkaProducerConfig("leader", false); err != nil || config.Producer.RequiredAcks != sarama.WaitForLocal || config.Producer.Idempotent {
+		t.Errorf("kafkaProducerConfig for leader acks returned %+v, %v", config, err)
+	}
+	if _, err := kafkaProducerConfig("leader", true); err == nil {
+		t.Error("kafkaProducerConfig accepted an idempotent producer without acks from all replicas")
+	}
+	if _, err := kafkaProducerConfig("some", false); err == nil {
+		t.Error("kafkaProducerConfig accepted unknown acks")
+	}
+}
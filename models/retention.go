@@ -0,0 +1,388 @@
+package models
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OrderArchiver is implemented by the order stores whose old orders can be archived by the RetentionJob
+type OrderArchiver interface {
+	// ExpiredOrders returns up to limit orders in a terminal status created before cutoff,
+	// with an ID after afterID, in ID order. Pass primitive.NilObjectID for the first page.
+	ExpiredOrders(cutoff time.Time, afterID primitive.ObjectID, limit int) ([]Order, error)
+
+	// DeleteOrders removes archived orders from the store and returns how many it removed
+	DeleteOrders(ids []primitive.ObjectID) (int, error)
+}
+
+// ArchiveSink keeps the orders removed by a RetentionJob. Archive must have stored
+// the orders durably when it returns, they are deleted right after.
+type ArchiveSink interface {
+	Archive(orders []Order) error
+	Close() error
+}
+
+// RetentionPolicy decides which orders are archived
+type RetentionPolicy struct {
+	MaxAge    time.Duration // orders in a terminal status created longer ago are archived
+	DryRun    bool          // only report what would be archived
+	BatchSize int
+}
+
+// RetentionReport is the progress of a run of the RetentionJob
+type RetentionReport struct {
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"` // nil while the run is in progress
+	Cutoff   time.Time  `json:"cutoff"`
+	DryRun   bool       `json:"dryRun"`
+	Expired  int        `json:"expired"`  // expired orders found so far
+	Archived int        `json:"archived"` // orders archived so far, zero on a dry run
+	Deleted  int        `json:"deleted"`  // archived orders deleted so far, zero on a dry run
+	Error    string     `json:"error,omitempty"`
+}
+
+// RetentionJob moves orders past their retention out of the order store into an archive
+type RetentionJob struct {
+	store    OrderArchiver
+	policy   RetentionPolicy
+	openSink func() (ArchiveSink, error) // a sink for each run
+}
+
+// Retention settings from the RETENTION_* environment variables, see initRetention
+var (
+	retentionMaxAge     time.Duration // zero disables retention
+	retentionInterval   time.Duration // zero only runs retention with "captureorderfd archive"
+	retentionWorker     = os.Getenv("RETENTION_WORKER") == "true"
+	retentionDryRun     = os.Getenv("RETENTION_DRY_RUN") == "true"
+	retentionArchive    = getEnv("RETENTION_ARCHIVE", "collection")
+	retentionArchiveDir = getEnv("RETENTION_ARCHIVE_DIR", "archive")
+)
+
+const retentionBatchSize = 100
+
+var lastRetentionReport = struct {
+	sync.Mutex
+	report *RetentionReport
+}{}
+
+// LastRetentionReport returns the progress of the current or last retention run, or nil if none ran yet
+func LastRetentionReport() *RetentionReport {
+	lastRetentionReport.Lock()
+	defer lastRetentionReport.Unlock()
+
+	if lastRetentionReport.report == nil {
+		return nil
+	}
+	report := *lastRetentionReport.report
+	return &report
+}
+
+// NewRetentionJob returns the job archiving the orders of store as configured by the RETENTION_* environment variables
+func NewRetentionJob(store OrderStore) (*RetentionJob, error) {
+	if retentionMaxAge <= 0 {
+		return nil, fmt.Errorf("retention is disabled, set RETENTION_MAX_AGE to enable it")
+	}
+	archiver, ok := store.(OrderArchiver)
+	if !ok {
+		return nil, fmt.Errorf("the order store doesn't support retention")
+	}
+
+	job := &RetentionJob{store: archiver, policy: RetentionPolicy{MaxAge: retentionMaxAge, DryRun: retentionDryRun, BatchSize: retentionBatchSize}}
+	switch retentionArchive {
+	case "collection":
+		mongoStore, ok := store.(*MongoOrderStore)
+		if !ok {
+			return nil, fmt.Errorf("RETENTION_ARCHIVE=collection needs the mongo order store, use ndjson instead")
+		}
+		job.openSink = func() (ArchiveSink, error) { return &mongoArchive{store: mongoStore}, nil }
+	case "ndjson":
+		job.openSink = func() (ArchiveSink, error) { return newNDJSONArchive(retentionArchiveDir, time.Now().UTC()) }
+	default:
+		return nil, fmt.Errorf("unknown RETENTION_ARCHIVE %q, use collection or ndjson", retentionArchive)
+	}
+	return job, nil
+}
+
+// StartRetention runs the retention job in the background every RETENTION_INTERVAL, if retention is enabled and scheduled
+// and this instance is the retention worker. Every replica of the API calls it, so only the one with RETENTION_WORKER runs it.
+func StartRetention(store OrderStore) {
+	if retentionMaxAge <= 0 || retentionInterval <= 0 {
+		return
+	}
+	if !retentionWorker {
+		log.Println("Retention isn't scheduled on this instance. Set RETENTION_WORKER=true on a single instance to run it every RETENTION_INTERVAL.")
+		return
+	}
+	job, err := NewRetentionJob(store)
+	if err != nil {
+		printErr("Can't schedule retention: ", err)
+		return
+	}
+
+	log.Printf("Archiving orders older than %v every %v", retentionMaxAge, retentionInterval)
+	go func() {
+		for {
+			job.Run()
+			time.Sleep(retentionInterval)
+		}
+	}()
+}
+
+// RunRetention archives the expired orders once, see "captureorderfd archive"
+func RunRetention() (RetentionReport, error) {
+	store, _, _, err := NewOrderStore()
+	if err != nil {
+		return RetentionReport{}, err
+	}
+	job, err := NewRetentionJob(store)
+	if err != nil {
+		return RetentionReport{}, err
+	}
+	report := job.Run()
+	if report.Error != "" {
+		return report, fmt.Errorf("%s", report.Error)
+	}
+	return report, nil
+}
+
+// Run archives and then deletes every expired order, batch by batch, and returns what it did.
+// Orders are only deleted once their batch was archived.
+func (j *RetentionJob) Run() RetentionReport {
+	now := time.Now().UTC()
+	report := &RetentionReport{Started: now, Cutoff: now.Add(-j.policy.MaxAge), DryRun: j.policy.DryRun}
+	j.publish(report)
+
+	err := j.run(report)
+	finished := time.Now().UTC()
+	report.Finished = &finished
+	if err != nil {
+		report.Error = err.Error()
+		printErr("Retention stopped: ", err)
+	}
+	j.publish(report)
+
+	log.Printf("Retention finished in %v: %d expired, %d archived, %d deleted (dry run: %t)",
+		finished.Sub(report.Started), report.Expired, report.Archived, report.Deleted, report.DryRun)
+	return *report
+}
+
+// run does the work of Run, updating report as it goes
+func (j *RetentionJob) run(report *RetentionReport) error {
+	log.Printf("Retention started: archiving orders in %s status created before %s (dry run: %t)",
+		strings.Join(terminalStatuses(), ", "), report.Cutoff.Format(time.RFC3339), report.DryRun)
+
+	var sink ArchiveSink
+	if !j.policy.DryRun {
+		var err error
+		if sink, err = j.openSink(); err != nil {
+			return err
+		}
+		defer sink.Close()
+	}
+
+	afterID := primitive.NilObjectID
+	for {
+		orders, err := j.store.ExpiredOrders(report.Cutoff, afterID, j.policy.BatchSize)
+		if err != nil {
+			return err
+		}
+		if len(orders) == 0 {
+			return nil
+		}
+		afterID = orders[len(orders)-1].ID
+		report.Expired += len(orders)
+
+		if !j.policy.DryRun {
+			if err := sink.Archive(orders); err != nil {
+				return err
+			}
+			report.Archived += len(orders)
+
+			ids := make([]primitive.ObjectID, len(orders))
+			for i, order := range orders {
+				ids[i] = order.ID
+			}
+			deleted, err := j.store.DeleteOrders(ids)
+			report.Deleted += deleted
+			if err != nil {
+				return err
+			}
+		}
+
+		j.publish(report)
+		log.Printf("Retention progress: %d expired, %d archived, %d deleted", report.Expired, report.Archived, report.Deleted)
+	}
+}
+
+// publish makes the progress of a run available to LastRetentionReport
+func (j *RetentionJob) publish(report *RetentionReport) {
+	lastRetentionReport.Lock()
+	defer lastRetentionReport.Unlock()
+
+	snapshot := *report
+	lastRetentionReport.report = &snapshot
+}
+
+// mongoArchive archives orders to the archive collection next to the orders collection
+type mongoArchive struct {
+	store *MongoOrderStore
+}
+
+// Archive upserts the orders, so archiving an order twice keeps a single copy
+func (a *mongoArchive) Archive(orders []Order) error {
+	writes := make([]mongo.WriteModel, len(orders))
+	for i, order := range orders {
+		writes[i] = mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": order.ID}).SetReplacement(order).SetUpsert(true)
+	}
+
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	return retryThrottled(ctx, "archive orders", func() error {
+		_, err := a.store.archivedOrders().BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		return err
+	})
+}
+
+func (a *mongoArchive) Close() error {
+	return nil
+}
+
+// ndjsonArchive archives orders to a gzipped file with one JSON order per line
+type ndjsonArchive struct {
+	file *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+}
+
+// newNDJSONArchive creates a new archive file in dir, named after the time of the run
+func newNDJSONArchive(dir string, at time.Time) (*ndjsonArchive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "orders-"+at.Format("20060102T150405Z")+".ndjson.gz")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Archiving orders to", path)
+
+	gz := gzip.NewWriter(file)
+	return &ndjsonArchive{file: file, gz: gz, enc: json.NewEncoder(gz)}, nil
+}
+
+// Archive appends the orders and syncs the file, so they are on disk before they are deleted
+func (a *ndjsonArchive) Archive(orders []Order) error {
+	for _, order := range orders {
+		if err := a.enc.Encode(order); err != nil {
+			return err
+		}
+	}
+	if err := a.gz.Flush(); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+func (a *ndjsonArchive) Close() error {
+	if err := a.gz.Close(); err != nil {
+		a.file.Close()
+		return err
+	}
+	return a.file.Close()
+}
+
+// ExpiredOrders returns a page of orders in MongoDB/CosmosDB past their retention, see OrderArchiver
+func (s *MongoOrderStore) ExpiredOrders(cutoff time.Time, afterID primitive.ObjectID, limit int) ([]Order, error) {
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	query := bson.M{
+		"_id":       bson.M{"$gt": afterID},
+		"status":    bson.M{"$in": terminalStatuses()},
+		"createdAt": bson.M{"$lt": cutoff},
+		"outbox.0":  bson.M{"$exists": false}, // not before the relay sent its messages
+	}
+	orders := []Order{}
+	err := retryThrottled(ctx, "find expired orders", func() error {
+		cursor, err := s.orders().Find(ctx, query, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit)))
+		if err == nil {
+			err = cursor.All(ctx, &orders)
+		}
+		return err
+	})
+	if err != nil {
+		printErr("Problem finding expired orders: ", err)
+	}
+	return orders, err
+}
+
+// DeleteOrders removes archived orders from MongoDB/CosmosDB
+func (s *MongoOrderStore) DeleteOrders(ids []primitive.ObjectID) (int, error) {
+	ctx, cancel := mongoContext()
+	defer cancel()
+
+	var deleted int64
+	err := retryThrottled(ctx, "delete archived orders", func() error {
+		result, err := s.orders().DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err == nil {
+			deleted += result.DeletedCount
+		}
+		return err
+	})
+	if err != nil {
+		printErr("Problem deleting archived orders: ", err)
+	}
+	return int(deleted), err
+}
+
+// archivedOrders returns the archive collection
+func (s *MongoOrderStore) archivedOrders() *mongo.Collection {
+	return s.mongoDBClient.Database(mongoDatabaseName).Collection(mongoCollectionName + "_archive")
+}
+
+// initRetention reads the retention settings
+func initRetention() {
+	if maxAge := os.Getenv("RETENTION_MAX_AGE"); maxAge != "" {
+		if d, err := parseRetentionDuration(maxAge); err == nil && d > 0 {
+			retentionMaxAge = d
+		} else {
+			printErr("Ignoring invalid RETENTION_MAX_AGE: ", maxAge)
+		}
+	}
+	if interval := os.Getenv("RETENTION_INTERVAL"); interval != "" {
+		if d, err := parseRetentionDuration(interval); err == nil && d > 0 {
+			retentionInterval = d
+		} else {
+			printErr("Ignoring invalid RETENTION_INTERVAL: ", interval)
+		}
+	}
+	if retentionMaxAge > 0 {
+		log.Printf("Orders in a terminal status are archived %v after they were created. You can override by setting the RETENTION_MAX_AGE environment variable.", retentionMaxAge)
+	}
+}
+
+// parseRetentionDuration parses a Go duration, or a number of days such as 90d
+func parseRetentionDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
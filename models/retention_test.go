@@ -0,0 +1,151 @@
+package models
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryArchive keeps archived orders in a slice
+type memoryArchive struct {
+	orders []Order
+}
+
+func (a *memoryArchive) Archive(orders []Order) error {
+	a.orders = append(a.orders, orders...)
+	return nil
+}
+
+func (a *memoryArchive) Close() error {
+	return nil
+}
+
+// newRetentionTestStore returns a store with an old closed, an old cancelled, an old open and a new closed order,
+// along with the IDs of the two expired orders
+func newRetentionTestStore(t *testing.T) (*MemoryOrderStore, []primitive.ObjectID) {
+	store := NewMemoryOrderStore()
+	old := time.Now().UTC().Add(-48 * time.Hour)
+
+	var expired []primitive.ObjectID
+	for _, status := range []string{StatusClosed, StatusCancelled, StatusOpen, StatusClosed} {
+		order, err := store.Create(newTestOrder("jane@example.com", "sku-1"))
+		if err != nil {
+			t.Fatalf("Create returned %v", err)
+		}
+		order.Status = status
+		if len(expired) < 2 {
+			order.CreatedAt = old
+			if status != StatusOpen {
+				expired = append(expired, order.ID)
+			}
+		}
+		store.orders[order.ID] = order
+	}
+	return store, expired
+}
+
+func TestIsTerminalStatus(t *testing.T) {
+	for status, terminal := range map[string]bool{StatusOpen: false, StatusFulfilled: false, StatusClosed: true, StatusCancelled: true, StatusFailed: true, "Unknown": false} {
+		if IsTerminalStatus(status) != terminal {
+			t.Errorf("IsTerminalStatus(%s) returned %t", status, !terminal)
+		}
+	}
+}
+
+func TestRetentionJob(t *testing.T) {
+	store, expired := newRetentionTestStore(t)
+	archive := &memoryArchive{}
+	job := &RetentionJob{
+		store:    store,
+		policy:   RetentionPolicy{MaxAge: 24 * time.Hour, BatchSize: 1},
+		openSink: func() (ArchiveSink, error) { return archive, nil },
+	}
+
+	// A dry run only counts
+	job.policy.DryRun = true
+	report := job.Run()
+	if report.Expired != 2 || report.Archived != 0 || report.Deleted != 0 || report.Finished == nil {
+		t.Errorf("The dry run reported %+v", report)
+	}
+	if count, _ := store.Count(); count != 4 || len(archive.orders) != 0 {
+		t.Errorf("The dry run left %d orders and archived %d", count, len(archive.orders))
+	}
+
+	job.policy.DryRun = false
+	report = job.Run()
+	if report.Expired != 2 || report.Archived != 2 || report.Deleted != 2 || report.Error != "" {
+		t.Errorf("The run reported %+v", report)
+	}
+	if last := LastRetentionReport(); last == nil || last.Deleted != 2 {
+		t.Errorf("LastRetentionReport returned %+v", last)
+	}
+	if len(archive.orders) != 2 || archive.orders[0].ID != expired[0] || archive.orders[1].ID != expired[1] {
+		t.Errorf("The run archived %+v, expected %v", archive.orders, expired)
+	}
+	for _, id := range expired {
+		if _, err := store.Get(id.Hex()); err != ErrOrderNotFound {
+			t.Errorf("The archived order %s is still in the store", id.Hex())
+		}
+	}
+	if count, _ := store.Count(); count != 2 {
+		t.Errorf("The run left %d orders, expected 2", count)
+	}
+}
+
+func TestNDJSONArchive(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := newNDJSONArchive(dir, time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("newNDJSONArchive returned %v", err)
+	}
+	orders := []Order{newTestOrder("jane@example.com", "sku-1"), newTestOrder("john@example.com", "sku-2")}
+	if err := archive.Archive(orders[:1]); err != nil {
+		t.Fatalf("Archive returned %v", err)
+	}
+	if err := archive.Archive(orders[1:]); err != nil {
+		t.Fatalf("Archive returned %v", err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("Close returned %v", err)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "orders-20261016T120000Z.ndjson.gz"))
+	if err != nil {
+		t.Fatalf("The archive file wasn't created: %v", err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("The archive file isn't gzipped: %v", err)
+	}
+
+	var emailAddresses []string
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		var order Order
+		if err := json.Unmarshal(scanner.Bytes(), &order); err != nil {
+			t.Fatalf("The archive contains an invalid line: %v", err)
+		}
+		emailAddresses = append(emailAddresses, order.EmailAddress)
+	}
+	if len(emailAddresses) != 2 || emailAddresses[0] != "jane@example.com" || emailAddresses[1] != "john@example.com" {
+		t.Errorf("The archive contains %v", emailAddresses)
+	}
+}
+
+func TestParseRetentionDuration(t *testing.T) {
+	for value, expected := range map[string]time.Duration{"90d": 90 * 24 * time.Hour, "36h": 36 * time.Hour} {
+		if d, err := parseRetentionDuration(value); err != nil || d != expected {
+			t.Errorf("parseRetentionDuration(%s) returned %v, %v", value, d, err)
+		}
+	}
+	if _, err := parseRetentionDuration("soon"); err == nil {
+		t.Error("parseRetentionDuration accepted soon")
+	}
+}
@@ -0,0 +1,602 @@
+package models
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Spool settings. Set SPOOL_DIR, ideally on a persistent volume, to spool the events the broker doesn't take.
+var (
+	spoolDir         = os.Getenv("SPOOL_DIR")
+	spoolSegmentSize = int64(4 << 20) // a new segment is started once the last one is this big
+)
+
+// Backoff between attempts to drain the spool while the broker is unavailable
+const (
+	spoolDrainInterval   = time.Second
+	spoolMaxDrainBackoff = time.Minute
+)
+
+// How long the IDs of events sent from the spool are remembered for the outbox relay to retry them.
+// The relay retries within outboxMaxBackoff, unless another instance sent the event meanwhile.
+const spoolSentMemory = time.Hour
+
+// spoolWrite writes a record to a segment, tests replace it to fail writes
+var spoolWrite = (*os.File).Write
+
+// spoolRecordHeaderSize is the size of the length and CRC-32 of the payload that precede every record
+const spoolRecordHeaderSize = 8
+
+// errSpoolRecordCorrupt is returned for a record that was only partly written or was damaged on disk
+var errSpoolRecordCorrupt = errors.New("spool record is corrupt")
+
+// spoolPosition is the position of a record in the spool
+type spoolPosition struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// SpoolStatus describes what is waiting in the spool
+type SpoolStatus struct {
+	Depth    int   `json:"depth"` // records waiting to be sent
+	Segments int   `json:"segments"`
+	Bytes    int64 `json:"bytes"` // size of the segment files, including the records already sent
+}
+
+// Spool is a durable FIFO queue of records kept in append-only segment files in a directory.
+// Every append is synced to disk before it returns. The position of the next record to send is
+// kept in a checkpoint file, and segments are deleted once all their records were acknowledged.
+// A record that was only partly written when the process died is dropped when the spool is opened.
+type Spool struct {
+	mu          sync.Mutex
+	dir         string
+	segmentSize int64
+
+	segments   []uint64 // numbers of the segment files, oldest first
+	active     *os.File // the last segment, records are appended to it
+	activeSize int64
+
+	read  spoolPosition // the next record to send
+	next  spoolPosition // the record after it, once Peek read it
+	depth int
+}
+
+// OpenSpool opens the spool in dir, creating it if needed, and recovers the records left by a previous run
+func OpenSpool(dir string, segmentSize int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Spool{dir: dir, segmentSize: segmentSize}
+
+	segments, err := s.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.readCheckpoint(); err != nil {
+		return nil, err
+	}
+
+	// Segments before the checkpoint were sent, they are left over from an interrupted compaction
+	for _, segment := range segments {
+		if segment < s.read.Segment {
+			os.Remove(s.segmentPath(segment))
+			continue
+		}
+		s.segments = append(s.segments, segment)
+	}
+	if len(s.segments) == 0 || s.segments[0] != s.read.Segment {
+		// The checkpoint points at a segment that doesn't exist, start from the oldest one
+		s.read = spoolPosition{Segment: 1}
+		if len(s.segments) > 0 {
+			s.read.Segment = s.segments[0]
+		}
+	}
+
+	for i, segment := range s.segments {
+		from := int64(0)
+		if segment == s.read.Segment {
+			from = s.read.Offset
+		}
+		count, end, err := scanSpoolSegment(s.segmentPath(segment), from)
+		if err != nil {
+			return nil, err
+		}
+		s.depth += count
+
+		if i == len(s.segments)-1 {
+			// Drop a record that was only partly written when the process stopped
+			if err := os.Truncate(s.segmentPath(segment), end); err != nil {
+				return nil, err
+			}
+			s.activeSize = end
+		} else if info, err := os.Stat(s.segmentPath(segment)); err == nil && info.Size() != end {
+			printErr(fmt.Sprintf("Spool segment %d is corrupt after %d bytes, skipping the rest of it", segment, end), nil)
+		}
+	}
+
+	if len(s.segments) == 0 {
+		if err := s.startSegment(s.read.Segment); err != nil {
+			return nil, err
+		}
+	} else if s.active, err = os.OpenFile(s.segmentPath(s.segments[len(s.segments)-1]), os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Opened the spool in %s with %d records waiting", dir, s.depth)
+	return s, nil
+}
+
+// Append adds a record at the end of the spool and syncs it to disk
+func (s *Spool) Append(payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.activeSize >= s.segmentSize {
+		if err := s.startSegment(s.segments[len(s.segments)-1] + 1); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, spoolRecordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[spoolRecordHeaderSize:], payload)
+
+	_, err := spoolWrite(s.active, record)
+	if err == nil {
+		err = s.active.Sync()
+	}
+	if err != nil {
+		s.discardPartialRecord()
+		return err
+	}
+	s.activeSize += int64(len(record))
+	s.depth++
+	return nil
+}
+
+// discardPartialRecord removes what a failed Append left after the last complete record, so that
+// later records aren't appended after it. If the segment can't be truncated, appending moves on to
+// a new segment and the partial record is skipped as corrupt when read. The caller must hold the lock.
+func (s *Spool) discardPartialRecord() {
+	err := s.active.Truncate(s.activeSize)
+	if err == nil {
+		err = s.active.Sync()
+	}
+	if err == nil {
+		return
+	}
+	printErr("Problem truncating a partly written spool record, starting a new segment: ", err)
+	if err := s.startSegment(s.segments[len(s.segments)-1] + 1); err != nil {
+		printErr("Problem starting a new spool segment: ", err)
+	}
+}
+
+// Peek returns the oldest record that wasn't acknowledged yet, or nil if the spool is empty
+func (s *Spool) Peek() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.depth > 0 {
+		payload, next, err := readSpoolRecord(s.segmentPath(s.read.Segment), s.read.Offset)
+		if err == io.EOF || err == errSpoolRecordCorrupt {
+			// The rest of this segment was read, or can't be, go on with the next one
+			if s.moveToNextSegment() {
+				continue
+			}
+			if err == io.EOF {
+				// The end of the segment appended to, nothing more was written yet
+				return nil, nil
+			}
+			return nil, err
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.next = spoolPosition{Segment: s.read.Segment, Offset: next}
+		return payload, nil
+	}
+	return nil, nil
+}
+
+// Ack removes the record returned by Peek from the spool
+func (s *Spool) Ack() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.next.Segment == 0 {
+		return errors.New("spool: Ack without Peek")
+	}
+	s.read, s.next = s.next, spoolPosition{}
+	s.depth--
+
+	if err := s.writeCheckpoint(); err != nil {
+		return err
+	}
+	return s.compact()
+}
+
+// Each calls fn with every record waiting in the spool, oldest first
+func (s *Spool) Each(fn func(payload []byte)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, segment := range s.segments {
+		if segment < s.read.Segment {
+			continue
+		}
+		offset := int64(0)
+		if segment == s.read.Segment {
+			offset = s.read.Offset
+		}
+		for {
+			payload, next, err := readSpoolRecord(s.segmentPath(segment), offset)
+			if err == io.EOF || err == errSpoolRecordCorrupt {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			fn(payload)
+			offset = next
+		}
+	}
+	return nil
+}
+
+// Depth returns how many records are waiting in the spool
+func (s *Spool) Depth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.depth
+}
+
+// Status describes what is waiting in the spool
+func (s *Spool) Status() SpoolStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := SpoolStatus{Depth: s.depth, Segments: len(s.segments)}
+	for _, segment := range s.segments {
+		if info, err := os.Stat(s.segmentPath(segment)); err == nil {
+			status.Bytes += info.Size()
+		}
+	}
+	return status
+}
+
+// Close closes the segment records are appended to
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.active.Close()
+}
+
+// compact deletes the segments whose records were all acknowledged. When everything was sent
+// a new segment is started, so the last one can be deleted too. The caller must hold the lock.
+func (s *Spool) compact() error {
+	last := s.segments[len(s.segments)-1]
+	if s.depth == 0 && s.read.Segment == last && s.activeSize > 0 {
+		if err := s.startSegment(last + 1); err != nil {
+			return err
+		}
+		s.read = spoolPosition{Segment: last + 1}
+		if err := s.writeCheckpoint(); err != nil {
+			return err
+		}
+	}
+
+	for len(s.segments) > 1 && s.segments[0] < s.read.Segment {
+		if err := os.Remove(s.segmentPath(s.segments[0])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.segments = s.segments[1:]
+	}
+	return nil
+}
+
+// moveToNextSegment moves the read position to the start of the next segment, if any.
+// The caller must hold the lock.
+func (s *Spool) moveToNextSegment() bool {
+	for _, segment := range s.segments {
+		if segment > s.read.Segment {
+			s.read = spoolPosition{Segment: segment}
+			return true
+		}
+	}
+	return false
+}
+
+// startSegment creates a new empty segment and appends to it from now on. The caller must hold the lock.
+func (s *Spool) startSegment(segment uint64) error {
+	file, err := os.OpenFile(s.segmentPath(segment), os.O_WRONLY|os.O_CREATE|os.O_APPEND|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		file.Close()
+		return err
+	}
+	if s.active != nil {
+		s.active.Close()
+	}
+	s.active = file
+	s.activeSize = 0
+	s.segments = append(s.segments, segment)
+	return nil
+}
+
+// readCheckpoint reads the read position, which is the start of the spool if there is no checkpoint yet
+func (s *Spool) readCheckpoint() error {
+	s.read = spoolPosition{Segment: 1}
+	b, err := os.ReadFile(filepath.Join(s.dir, "checkpoint"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &s.read)
+}
+
+// writeCheckpoint atomically replaces the checkpoint with the read position. The caller must hold the lock.
+func (s *Spool) writeCheckpoint() error {
+	b, _ := json.Marshal(s.read)
+	tmp := filepath.Join(s.dir, "checkpoint.tmp")
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(b); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, "checkpoint")); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// listSegments returns the numbers of the segment files in the spool directory, oldest first
+func (s *Spool) listSegments() ([]uint64, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	var segments []uint64
+	for _, path := range paths {
+		if segment, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), ".seg"), 10, 64); err == nil {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (s *Spool) segmentPath(segment uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d.seg", segment))
+}
+
+// scanSpoolSegment counts the valid records of a segment from an offset,
+// and returns where the last valid record ends
+func scanSpoolSegment(path string, from int64) (count int, end int64, err error) {
+	end = from
+	for {
+		_, next, err := readSpoolRecord(path, end)
+		if err == io.EOF || err == errSpoolRecordCorrupt {
+			return count, end, nil
+		}
+		if err != nil {
+			return count, end, err
+		}
+		count++
+		end = next
+	}
+}
+
+// readSpoolRecord reads the record at offset in a segment and returns it with the offset of the next record.
+// It returns io.EOF at the end of the segment.
+func readSpoolRecord(path string, offset int64) ([]byte, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	header := make([]byte, spoolRecordHeaderSize)
+	if _, err := file.ReadAt(header, offset); err == io.EOF {
+		// A header that was cut short is a partly written record
+		if info, statErr := file.Stat(); statErr == nil && info.Size() > offset {
+			return nil, 0, errSpoolRecordCorrupt
+		}
+		return nil, 0, io.EOF
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := file.ReadAt(payload, offset+spoolRecordHeaderSize); err == io.EOF {
+		return nil, 0, errSpoolRecordCorrupt
+	} else if err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errSpoolRecordCorrupt
+	}
+	return payload, offset + spoolRecordHeaderSize + int64(len(payload)), nil
+}
+
+// syncDir syncs a directory so the files created or renamed in it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// SpoolingPublisher publishes events with another OrderPublisher and spools those that
+// aren't acknowledged, so they survive the broker being unavailable and restarts. Spooled
+// events are sent in order before any newer event. The outbox stays the record of what was
+// sent: a spooled event is only acknowledged once it was sent from the spool.
+type SpoolingPublisher struct {
+	mu        sync.Mutex // keeps events in order while sending them
+	publisher OrderPublisher
+	spool     *Spool
+	spooled   map[string]bool      // IDs of the events in the spool
+	sent      map[string]time.Time // IDs of the events sent from the spool since they were published, and when
+}
+
+// activeSpool is the spool of the publisher in use, reported by SpoolMetrics
+var activeSpool *Spool
+
+// NewSpoolingPublisher returns a publisher spooling the events publisher doesn't take to spool.
+// The events already in spool are recognized when the outbox relay publishes them again.
+func NewSpoolingPublisher(publisher OrderPublisher, spool *Spool) *SpoolingPublisher {
+	p := &SpoolingPublisher{publisher: publisher, spool: spool, spooled: map[string]bool{}, sent: map[string]time.Time{}}
+	err := spool.Each(func(payload []byte) {
+		var event CloudEvent
+		if json.Unmarshal(payload, &event) == nil {
+			p.spooled[event.ID] = true
+		}
+	})
+	if err != nil {
+		printErr("Problem reading the spooled events, they may be spooled again: ", err)
+	}
+	return p
+}
+
+// SpoolMetrics describes what is waiting in the spool, or returns nil when events aren't spooled
+func SpoolMetrics() *SpoolStatus {
+	if activeSpool == nil {
+		return nil
+	}
+	status := activeSpool.Status()
+	return &status
+}
+
+// Publish sends the event, or spools it if the broker doesn't take it or older events are still spooled.
+// It only returns true once the broker took the event, so the outbox relay retries a spooled event
+// until it was sent from the spool. Retrying an event that is still spooled doesn't spool it again.
+func (p *SpoolingPublisher) Publish(event CloudEvent) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, at := range p.sent {
+		if time.Since(at) > spoolSentMemory {
+			delete(p.sent, id)
+		}
+	}
+	if _, sent := p.sent[event.ID]; sent {
+		delete(p.sent, event.ID)
+		return true
+	}
+	if p.spooled[event.ID] {
+		return false
+	}
+
+	if p.spool.Depth() == 0 && p.publisher.Publish(event) {
+		return true
+	}
+
+	body, _ := json.Marshal(event)
+	if err := p.spool.Append(body); err != nil {
+		printErr("Problem spooling event: ", err)
+		return false
+	}
+	p.spooled[event.ID] = true
+	log.Printf("Spooled %s event %s for order %s, %d events are waiting for the broker", event.Type, event.ID, event.Subject, p.spool.Depth())
+	return false
+}
+
+// Start drains the spool in the background, backing off while the broker is unavailable
+func (p *SpoolingPublisher) Start() {
+	go func() {
+		backoff := spoolDrainInterval
+		for {
+			sent, drained := p.DrainPending()
+			switch {
+			case drained:
+				backoff = spoolDrainInterval
+			case sent == 0 && backoff < spoolMaxDrainBackoff:
+				backoff *= 2
+			}
+			time.Sleep(backoff)
+		}
+	}()
+}
+
+// DrainPending sends the spooled events in order until the spool is empty or the broker doesn't
+// take one. It returns how many it sent and whether the spool is now empty.
+func (p *SpoolingPublisher) DrainPending() (int, bool) {
+	sent := 0
+	for {
+		drained, ok := p.drainOne()
+		if !ok {
+			return sent, false
+		}
+		if drained {
+			if sent > 0 {
+				log.Printf("Sent %d spooled events, the spool is empty", sent)
+			}
+			return sent, true
+		}
+		sent++
+	}
+}
+
+// drainOne sends the oldest spooled event. It reports whether the spool was empty, and
+// false if the event wasn't sent.
+func (p *SpoolingPublisher) drainOne() (empty bool, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	payload, err := p.spool.Peek()
+	if err != nil {
+		printErr("Problem reading the spool: ", err)
+		return false, false
+	}
+	if payload == nil {
+		return true, true
+	}
+
+	var event CloudEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		// It can never be sent, don't let it hold up the rest
+		printErr("Dropping an unreadable spooled event: ", err)
+	} else if !p.publisher.Publish(event) {
+		return false, false
+	}
+
+	if err := p.spool.Ack(); err != nil {
+		printErr("Problem acknowledging a spooled event: ", err)
+		return false, false
+	}
+	if p.spooled[event.ID] {
+		delete(p.spooled, event.ID)
+		p.sent[event.ID] = time.Now()
+	}
+	return false, true
+}
@@ -0,0 +1,209 @@
+package models
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := spool.Append([]byte("record " + strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status := spool.Status(); status.Depth != 10 || status.Segments < 2 {
+		t.Fatalf("The spool has %+v, expected 10 records in several segments", status)
+	}
+
+	// Records come out in order and are kept until acknowledged
+	for i := 0; i < 4; i++ {
+		record, err := spool.Peek()
+		if err != nil || string(record) != "record "+strconv.Itoa(i) {
+			t.Fatalf("Peek returned %q, %v, expected record %d", record, err, i)
+		}
+		if i < 3 {
+			if err := spool.Ack(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	segments := spool.Status().Segments
+	spool.Close()
+
+	// The unacknowledged records survive a restart
+	spool, err = OpenSpool(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth := spool.Depth(); depth != 7 {
+		t.Fatalf("The reopened spool has %d records, expected 7", depth)
+	}
+	if record, _ := spool.Peek(); string(record) != "record 3" {
+		t.Errorf("The reopened spool starts at %q, expected record 3", record)
+	}
+
+	// Drained segments are deleted
+	for spool.Depth() > 0 {
+		if _, err := spool.Peek(); err != nil {
+			t.Fatal(err)
+		}
+		spool.Ack()
+	}
+	if status := spool.Status(); status.Depth != 0 || status.Segments != 1 || status.Bytes != 0 {
+		t.Errorf("The drained spool has %+v, expected a single empty segment", status)
+	}
+	if record, err := spool.Peek(); record != nil || err != nil {
+		t.Errorf("Peek on the drained spool returned %q, %v", record, err)
+	}
+	if segments < 2 {
+		t.Errorf("The spool had %d segments before draining", segments)
+	}
+	spool.Close()
+}
+
+func TestSpoolPartialWrite(t *testing.T) {
+	dir := t.TempDir()
+	spool, _ := OpenSpool(dir, 1<<20)
+	spool.Append([]byte("complete"))
+	spool.Append([]byte("torn"))
+	spool.Close()
+
+	// Lose the end of the last record, as if the process died while writing it
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	info, _ := os.Stat(paths[0])
+	os.Truncate(paths[0], info.Size()-2)
+
+	spool, err := OpenSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth := spool.Depth(); depth != 1 {
+		t.Fatalf("The spool recovered %d records, expected 1", depth)
+	}
+	// New records are appended after the last complete one
+	spool.Append([]byte("after"))
+	for _, expected := range []string{"complete", "after"} {
+		if record, _ := spool.Peek(); string(record) != expected {
+			t.Errorf("Peek returned %q, expected %q", record, expected)
+		}
+		spool.Ack()
+	}
+	spool.Close()
+}
+
+func TestSpoolFailedWrite(t *testing.T) {
+	defer func(write func(*os.File, []byte) (int, error)) { spoolWrite = write }(spoolWrite)
+	dir := t.TempDir()
+	spool, _ := OpenSpool(dir, 1<<20)
+	spool.Append([]byte("before"))
+
+	// Only half of the record reaches the segment
+	spoolWrite = func(file *os.File, record []byte) (int, error) {
+		n, _ := file.Write(record[:len(record)/2])
+		return n, errors.New("disk full")
+	}
+	if err := spool.Append([]byte("lost")); err == nil {
+		t.Fatal("Append of a record that wasn't written succeeded")
+	}
+	spoolWrite = (*os.File).Write
+	spool.Append([]byte("after"))
+
+	// The records after the failed one are read, before and after a restart
+	for _, expected := range []string{"before", "after"} {
+		if record, err := spool.Peek(); string(record) != expected || err != nil {
+			t.Errorf("Peek returned %q, %v, expected %q", record, err, expected)
+		}
+		spool.Ack()
+	}
+	if record, err := spool.Peek(); record != nil || err != nil {
+		t.Errorf("Peek on the drained spool returned %q, %v", record, err)
+	}
+	spool.Append([]byte("kept"))
+	spool.Close()
+
+	spool, err := OpenSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if record, _ := spool.Peek(); spool.Depth() != 1 || string(record) != "kept" {
+		t.Errorf("The reopened spool has %d records starting with %q, expected kept", spool.Depth(), record)
+	}
+}
+
+func TestSpoolingPublisher(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := &recordingPublisher{}
+	publisher := NewSpoolingPublisher(broker, spool)
+
+	event := func(subject string) CloudEvent {
+		return CloudEvent{SpecVersion: "1.0", Type: OrderCreatedEventType, ID: primitive.NewObjectID().Hex(), Time: time.Now().UTC(), Subject: subject}
+	}
+
+	// Events the broker doesn't take are spooled but not acknowledged, the outbox keeps them
+	first := event("first")
+	if publisher.Publish(first) || spool.Depth() != 1 {
+		t.Fatalf("The unsent event was acknowledged or not spooled, the spool has %d events", spool.Depth())
+	}
+	// While events are spooled newer ones queue behind them, even if the broker is back
+	broker.acknowledge = true
+	broker.sent = nil
+	if publisher.Publish(event("second")) || len(broker.sent) != 0 || spool.Depth() != 2 {
+		t.Fatalf("An event overtook the spool: sent %d, spooled %d", len(broker.sent), spool.Depth())
+	}
+	// The outbox relay retrying a spooled event doesn't spool it again
+	if publisher.Publish(first) || spool.Depth() != 2 {
+		t.Fatalf("A retried spooled event was acknowledged or spooled again, the spool has %d events", spool.Depth())
+	}
+
+	if sent, drained := publisher.DrainPending(); sent != 2 || !drained {
+		t.Fatalf("DrainPending sent %d events, drained %t", sent, drained)
+	}
+	if len(broker.sent) != 2 || broker.sent[0].Subject != "first" || broker.sent[1].Subject != "second" {
+		t.Errorf("The spooled events were sent as %+v", broker.sent)
+	}
+	// Once sent from the spool the retried event is acknowledged without sending it again
+	if !publisher.Publish(first) || len(broker.sent) != 2 {
+		t.Errorf("The retry of an event sent from the spool wasn't acknowledged, sent %d", len(broker.sent))
+	}
+
+	// Once drained, events go straight to the broker
+	if !publisher.Publish(event("third")) || len(broker.sent) != 3 || spool.Depth() != 0 {
+		t.Errorf("The event after draining wasn't sent directly: sent %d, spooled %d", len(broker.sent), spool.Depth())
+	}
+
+	// Draining stops at the first event the broker doesn't take
+	broker.acknowledge = false
+	fourth := event("fourth")
+	publisher.Publish(fourth)
+	if sent, drained := publisher.DrainPending(); sent != 0 || drained || spool.Depth() != 1 {
+		t.Errorf("DrainPending sent %d events while the broker was down, drained %t, %d left", sent, drained, spool.Depth())
+	}
+
+	// Events spooled before a restart are recognized when the relay retries them
+	spool.Close()
+	spool, err = OpenSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	publisher = NewSpoolingPublisher(broker, spool)
+	if publisher.Publish(fourth) || spool.Depth() != 1 {
+		t.Errorf("The event spooled before the restart was acknowledged or spooled again, the spool has %d events", spool.Depth())
+	}
+}
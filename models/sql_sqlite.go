@@ -0,0 +1,8 @@
+//go:build cgo
+// +build cgo
+
+package models
+
+// The SQLite driver needs cgo. The Docker image is built without it, so the
+// sqlite order store is only available in builds with CGO_ENABLED=1.
+import _ "github.com/mattn/go-sqlite3" // registers the sqlite3 driver
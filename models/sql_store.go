@@ -0,0 +1,706 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq" // registers the postgres driver
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SQLOrderStore is the OrderStore, IdempotencyStore and Outbox backed by a SQL database,
+// PostgreSQL in production or SQLite when running locally. Orders keep their
+// ObjectId so their IDs, ordering and cursors match MongoOrderStore. Line items,
+// status history and cancellation are stored as JSON text.
+type SQLOrderStore struct {
+	db      *sql.DB
+	dialect string // "postgres" or "sqlite3", the name of the database/sql driver
+}
+
+// sqlMigrations create and evolve the schema. They are applied in order and recorded
+// in schema_migrations, so append new migrations and never change applied ones.
+// Stick to SQL that both PostgreSQL and SQLite understand.
+var sqlMigrations = []string{
+	`CREATE TABLE orders (
+		id CHAR(24) PRIMARY KEY,
+		email_address TEXT NOT NULL,
+		email_address_normalized TEXT NOT NULL,
+		product TEXT NOT NULL DEFAULT '',
+		items TEXT NOT NULL,
+		subtotal DOUBLE PRECISION NOT NULL,
+		total DOUBLE PRECISION NOT NULL,
+		status TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		status_history TEXT NOT NULL,
+		cancellation TEXT
+	)`,
+	`CREATE INDEX orders_email_address_normalized ON orders (email_address_normalized)`,
+	// The SKUs of every order, so orders can be listed by product without parsing items
+	`CREATE TABLE order_skus (
+		order_id CHAR(24) NOT NULL REFERENCES orders (id),
+		sku TEXT NOT NULL,
+		PRIMARY KEY (order_id, sku)
+	)`,
+	`CREATE INDEX order_skus_sku ON order_skus (sku)`,
+	`CREATE TABLE idempotency_keys (
+		idempotency_key TEXT PRIMARY KEY,
+		request_hash TEXT NOT NULL,
+		order_id TEXT NOT NULL DEFAULT '',
+		status_code INTEGER NOT NULL DEFAULT 0,
+		response TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE outbox (
+		id CHAR(24) PRIMARY KEY,
+		order_id CHAR(24) NOT NULL,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP NOT NULL,
+		last_error TEXT NOT NULL DEFAULT '',
+		delivered_at TIMESTAMP
+	)`,
+	`CREATE INDEX outbox_next_attempt_at ON outbox (next_attempt_at)`,
+	// Finds the orders past their retention
+	`CREATE INDEX orders_status_created_at ON orders (status, created_at)`,
+	`ALTER TABLE orders ADD COLUMN version BIGINT NOT NULL DEFAULT 0`,
+	// Identifies the request holding an idempotency key, so it can't complete a key taken over by another
+	`ALTER TABLE idempotency_keys ADD COLUMN reservation TEXT NOT NULL DEFAULT ''`,
+}
+
+// orderColumns are the columns scanned by scanOrder, in order
+const orderColumns = "id, email_address, email_address_normalized, product, items, subtotal, total, status, created_at, status_history, cancellation, version"
+
+// NewSQLOrderStore opens the database with the given database/sql driver, "postgres" or "sqlite3",
+// and brings its schema up to date.
+func NewSQLOrderStore(driverName string, dataSourceName string) (*SQLOrderStore, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if driverName == "sqlite3" {
+		// SQLite allows a single writer, so share one connection rather than fail with "database is locked"
+		db.SetMaxOpenConns(1)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		printErr(fmt.Sprintf("Can't connect to the %s database, go error: ", driverName), err)
+		return nil, err
+	}
+	log.Printf("\tConnected to the %s database", driverName)
+
+	s := &SQLOrderStore{db: db, dialect: driverName}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// sqlMigrationLock identifies the PostgreSQL advisory lock held while migrating. The value is arbitrary,
+// it only has to differ from the other advisory locks taken in the database.
+const sqlMigrationLock = 424201
+
+// migrate applies the migrations that haven't been applied yet, each in its own transaction.
+// On PostgreSQL it holds an advisory lock so that replicas starting together migrate one
+// after the other, and the ones that wait find the schema up to date.
+func (s *SQLOrderStore) migrate() error {
+	ctx := context.Background()
+
+	// The advisory lock belongs to a connection, so migrate on a single one
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if s.dialect == "postgres" {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, sqlMigrationLock); err != nil {
+			printErr("Problem locking the schema for migration: ", err)
+			return err
+		}
+		defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, sqlMigrationLock)
+	}
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at TIMESTAMP NOT NULL)`)
+	if err != nil {
+		printErr("Problem creating schema_migrations: ", err)
+		return err
+	}
+
+	// Read the version once locked, another replica may have just migrated
+	var current int
+	err = conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		printErr("Problem reading the schema version: ", err)
+		return err
+	}
+
+	for version := current + 1; version <= len(sqlMigrations); version++ {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(sqlMigrations[version-1]); err == nil {
+			_, err = tx.Exec(s.rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`), version, time.Now().UTC())
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+		if err != nil {
+			printErr(fmt.Sprintf("Problem applying schema migration %d: ", version), err)
+			return err
+		}
+		log.Println("Applied schema migration", version)
+	}
+
+	log.Printf("Schema is at version %d", len(sqlMigrations))
+	return nil
+}
+
+// Create adds the order and its outbox message to the database in a single transaction
+func (s *SQLOrderStore) Create(order Order) (Order, error) {
+	prepareNewOrder(&order)
+
+	tx, err := s.db.Begin()
+	if err == nil {
+		if err = s.insertOrder(tx, order); err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	if err != nil {
+		printErr("Problem inserting order: ", err)
+		return order, err
+	}
+
+	log.Println("Inserted order:", order.ID.Hex())
+	return order, nil
+}
+
+// CreateMany adds a batch of orders to the database, each in its own transaction
+// so that one failing order doesn't stop the rest of the batch.
+func (s *SQLOrderStore) CreateMany(orders []Order) ([]Order, []error) {
+	errs := make([]error, len(orders))
+	for i := range orders {
+		orders[i], errs[i] = s.Create(orders[i])
+	}
+	return orders, errs
+}
+
+// insertOrder inserts a prepared order, its SKUs and its outbox message
+func (s *SQLOrderStore) insertOrder(tx *sql.Tx, order Order) error {
+	items, history, cancellation, err := marshalOrderColumns(order)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(s.rebind(`INSERT INTO orders (`+orderColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		order.ID.Hex(), order.EmailAddress, order.EmailAddressNormalized, order.Product, items,
+		order.Subtotal, order.Total, order.Status, order.CreatedAt, history, cancellation, order.Version)
+	if err != nil {
+		return err
+	}
+
+	skus := map[string]bool{}
+	for _, item := range order.Items {
+		if skus[item.SKU] {
+			continue
+		}
+		skus[item.SKU] = true
+		if _, err := tx.Exec(s.rebind(`INSERT INTO order_skus (order_id, sku) VALUES (?, ?)`), order.ID.Hex(), item.SKU); err != nil {
+			return err
+		}
+	}
+
+	return s.insertOutboxMessage(tx, newOrderAddedOutboxMessage(order))
+}
+
+// insertOutboxMessage adds a message to the outbox in the transaction writing the order it is about
+func (s *SQLOrderStore) insertOutboxMessage(tx *sql.Tx, message OutboxMessage) error {
+	_, err := tx.Exec(s.rebind(`INSERT INTO outbox (id, order_id, body, created_at, next_attempt_at) VALUES (?, ?, ?, ?, ?)`),
+		message.ID.Hex(), message.OrderID, message.Body, message.CreatedAt, message.NextAttemptAt)
+	return err
+}
+
+// Get retrieves a single order from the database by its hex ID
+func (s *SQLOrderStore) Get(orderID string) (Order, error) {
+	if _, err := primitive.ObjectIDFromHex(orderID); err != nil {
+		return Order{}, ErrInvalidOrderID
+	}
+
+	order, err := scanOrder(s.db.QueryRow(s.rebind(`SELECT `+orderColumns+` FROM orders WHERE id = ?`), orderID))
+	if err == sql.ErrNoRows {
+		return order, ErrOrderNotFound
+	}
+	if err != nil {
+		printErr("Problem retrieving order: ", err)
+		return order, err
+	}
+	return order, nil
+}
+
+// List returns a page of orders in the database matching the filter, with the same ordering and cursors as MongoOrderStore
+func (s *SQLOrderStore) List(filter OrderFilter) (OrderPage, error) {
+	page := OrderPage{Orders: []Order{}}
+
+	var where []string
+	var args []interface{}
+	if filter.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, filter.Status)
+	}
+	if filter.Product != "" {
+		// Legacy product orders are stored with the product as their single line item
+		where = append(where, "id IN (SELECT order_id FROM order_skus WHERE sku = ?)")
+		args = append(args, filter.Product)
+	}
+	if filter.EmailAddress != "" {
+		where = append(where, "email_address = ?")
+		args = append(args, filter.EmailAddress)
+	}
+	if !filter.CreatedFrom.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, filter.CreatedFrom.UTC())
+	}
+	if !filter.CreatedTo.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, filter.CreatedTo.UTC())
+	}
+
+	// Hex ObjectIds sort by creation time just like the ObjectIds themselves
+	order := "ASC"
+	cursorOperator := ">"
+	if filter.NewestFirst {
+		order = "DESC"
+		cursorOperator = "<"
+	}
+	if filter.Cursor != "" {
+		lastID, err := decodeOrderCursor(filter.Cursor)
+		if err != nil {
+			return page, err
+		}
+		where = append(where, "id "+cursorOperator+" ?")
+		args = append(args, lastID.Hex())
+	}
+
+	limit := pageSize(filter.Limit)
+
+	query := `SELECT ` + orderColumns + ` FROM orders`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	// Fetch one extra row to find out whether there is a next page
+	query += ` ORDER BY id ` + order + ` LIMIT ` + strconv.Itoa(limit+1)
+
+	orders, err := s.queryOrders(query, args...)
+	if err != nil {
+		printErr("Problem listing orders: ", err)
+		return page, err
+	}
+	page.Orders = orders
+
+	if len(page.Orders) > limit {
+		page.Orders = page.Orders[:limit]
+		page.NextCursor = encodeOrderCursor(page.Orders[limit-1].ID)
+	}
+
+	log.Println("Listed orders:", len(page.Orders))
+	return page, nil
+}
+
+// Count returns the number of orders in the database
+func (s *SQLOrderStore) Count() (int, error) {
+	var count int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM orders`).Scan(&count)
+	if err != nil {
+		printErr("Problem quering number of orders: ", err)
+	}
+	return count, err
+}
+
+// UpdateStatus applies transition to an order in the database, provided it is still at the version
+// it was read at. A cancellation message is added to the outbox in the same transaction.
+func (s *SQLOrderStore) UpdateStatus(read Order, transition StatusTransition, cancellation *Cancellation) (Order, error) {
+	order := applyStatusTransition(read, transition, cancellation)
+
+	tx, err := s.db.Begin()
+	if err == nil {
+		if err = s.updateOrderStatus(tx, read, order, cancellation != nil); err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	if err == ErrVersionConflict {
+		return order, err
+	}
+	if err != nil {
+		printErr("Problem updating order status: ", err)
+		return order, err
+	}
+
+	log.Printf("Order %s moved from %s to %s", order.ID.Hex(), transition.From, transition.To)
+	return order, nil
+}
+
+// updateOrderStatus writes the status, history and cancellation of order over the order as read,
+// along with the message announcing the cancellation if it was cancelled
+func (s *SQLOrderStore) updateOrderStatus(tx *sql.Tx, read Order, order Order, cancelled bool) error {
+	_, history, cancellation, err := marshalOrderColumns(order)
+	if err != nil {
+		return err
+	}
+
+	// The version still matching means nobody changed the order, including its history, since it was read
+	result, err := tx.Exec(s.rebind(`UPDATE orders SET status = ?, status_history = ?, cancellation = ?, version = version + 1 WHERE id = ? AND version = ?`),
+		order.Status, history, cancellation, read.ID.Hex(), read.Version)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		return ErrVersionConflict
+	}
+
+	if cancelled {
+		return s.insertOutboxMessage(tx, newOrderCancelledOutboxMessage(order))
+	}
+	return nil
+}
+
+// CustomerOrders returns the customer order history for a normalized email address from the database
+func (s *SQLOrderStore) CustomerOrders(normalized string, limit int) (CustomerOrderHistory, error) {
+	history := CustomerOrderHistory{EmailAddress: normalized, Orders: []Order{}}
+
+	orders, err := s.queryOrders(`SELECT `+orderColumns+` FROM orders WHERE email_address_normalized = ? ORDER BY id DESC LIMIT `+strconv.Itoa(limit), normalized)
+	if err != nil {
+		printErr("Problem querying customer orders: ", err)
+		return history, err
+	}
+	history.Orders = orders
+
+	var lifetimeValue sql.NullFloat64
+	err = s.db.QueryRow(s.rebind(`SELECT COUNT(*), SUM(CASE WHEN status IN (?, ?) THEN 0 ELSE total END) FROM orders WHERE email_address_normalized = ?`),
+		StatusCancelled, StatusFailed, normalized).Scan(&history.OrderCount, &lifetimeValue)
+	if err != nil {
+		printErr("Problem summing customer orders: ", err)
+		return history, err
+	}
+	history.LifetimeValue = roundToCents(lifetimeValue.Float64)
+
+	log.Println("Customer order count:", history.OrderCount)
+	return history, nil
+}
+
+// BeginIdempotentRequest reserves key for a request with the given hash, see IdempotencyStore
+func (s *SQLOrderStore) BeginIdempotentRequest(key string, requestHash string) (*IdempotencyRecord, string, error) {
+	if len(key) > MaxIdempotencyKeyLength {
+		return nil, "", ErrIdempotencyKeyTooLong
+	}
+
+	now := time.Now().UTC()
+	reservation := newIdempotencyReservation()
+	_, insertErr := s.db.Exec(s.rebind(`INSERT INTO idempotency_keys (idempotency_key, request_hash, created_at, reservation) VALUES (?, ?, ?, ?)`), key, requestHash, now, reservation)
+	if insertErr == nil {
+		return nil, reservation, nil
+	}
+
+	// The drivers report duplicate keys differently, so look for the existing key instead
+	existing, err := s.idempotencyRecord(key)
+	if err == sql.ErrNoRows {
+		printErr("Problem reserving idempotency key: ", insertErr)
+		return nil, "", insertErr
+	}
+	if err != nil {
+		printErr("Problem reading idempotency key: ", err)
+		return nil, "", err
+	}
+
+	if existing.expired() {
+		// The key expired, so take it over unless another request took it over or completed it since it was read
+		result, err := s.db.Exec(s.rebind(`UPDATE idempotency_keys SET request_hash = ?, order_id = '', status_code = 0, response = '', created_at = ?, reservation = ?
+			WHERE idempotency_key = ? AND created_at = ? AND status_code = ?`),
+			requestHash, now, reservation, key, existing.CreatedAt, existing.StatusCode)
+		if err != nil {
+			printErr("Problem replacing expired idempotency key: ", err)
+			return nil, "", err
+		}
+		if updated, err := result.RowsAffected(); err != nil {
+			return nil, "", err
+		} else if updated == 1 {
+			return nil, reservation, nil
+		}
+
+		// Another request got there first, answer with its record
+		if existing, err = s.idempotencyRecord(key); err == sql.ErrNoRows {
+			if _, err = s.db.Exec(s.rebind(`INSERT INTO idempotency_keys (idempotency_key, request_hash, created_at, reservation) VALUES (?, ?, ?, ?)`), key, requestHash, now, reservation); err != nil {
+				return nil, "", err
+			}
+			return nil, reservation, nil
+		} else if err != nil {
+			printErr("Problem reading idempotency key: ", err)
+			return nil, "", err
+		}
+	}
+
+	return &existing, "", nil
+}
+
+// idempotencyRecord reads the record of an idempotency key
+func (s *SQLOrderStore) idempotencyRecord(key string) (IdempotencyRecord, error) {
+	var record IdempotencyRecord
+	var response string
+	err := s.db.QueryRow(s.rebind(`SELECT idempotency_key, request_hash, order_id, status_code, response, created_at, reservation FROM idempotency_keys WHERE idempotency_key = ?`), key).
+		Scan(&record.Key, &record.RequestHash, &record.OrderID, &record.StatusCode, &response, &record.CreatedAt, &record.Reservation)
+	record.Response = []byte(response)
+	return record, err
+}
+
+// CompleteIdempotentRequest stores the response of a request reserved with BeginIdempotentRequest,
+// unless another request took the key over since
+func (s *SQLOrderStore) CompleteIdempotentRequest(key string, reservation string, orderID string, statusCode int, response []byte) error {
+	result, err := s.db.Exec(s.rebind(`UPDATE idempotency_keys SET order_id = ?, status_code = ?, response = ?
+		WHERE idempotency_key = ? AND reservation = ? AND status_code = 0`),
+		orderID, statusCode, string(response), key, reservation)
+	if err != nil {
+		printErr("Problem storing idempotent response: ", err)
+		return err
+	}
+	return requireIdempotencyReservation(result)
+}
+
+// ReleaseIdempotentRequest forgets a key reserved with BeginIdempotentRequest
+// so that a request which failed can be retried with the same key.
+func (s *SQLOrderStore) ReleaseIdempotentRequest(key string, reservation string) error {
+	result, err := s.db.Exec(s.rebind(`DELETE FROM idempotency_keys WHERE idempotency_key = ? AND reservation = ? AND status_code = 0`), key, reservation)
+	if err != nil {
+		printErr("Problem releasing idempotency key: ", err)
+		return err
+	}
+	return requireIdempotencyReservation(result)
+}
+
+// requireIdempotencyReservation reports ErrIdempotencyReservationLost when a statement
+// filtered on a reservation didn't find it
+func requireIdempotencyReservation(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrIdempotencyReservationLost
+	}
+	return nil
+}
+
+// ClaimOutboxMessages claims due messages in the database, oldest first, see Outbox
+func (s *SQLOrderStore) ClaimOutboxMessages(limit int, lease time.Duration) ([]OutboxMessage, error) {
+	now := time.Now().UTC()
+
+	rows, err := s.db.Query(s.rebind(`SELECT id, order_id, body, created_at, attempts, next_attempt_at, last_error FROM outbox
+		WHERE delivered_at IS NULL AND next_attempt_at <= ? ORDER BY next_attempt_at LIMIT `+strconv.Itoa(limit)), now)
+	if err != nil {
+		return nil, err
+	}
+	var due []OutboxMessage
+	for rows.Next() {
+		var message OutboxMessage
+		var id string
+		if err := rows.Scan(&id, &message.OrderID, &message.Body, &message.CreatedAt, &message.Attempts, &message.NextAttemptAt, &message.LastError); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if message.ID, err = primitive.ObjectIDFromHex(strings.TrimSpace(id)); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		message.OrderID = strings.TrimSpace(message.OrderID)
+		due = append(due, message)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Another relay may have claimed a message since it was read, in which case it is no longer due
+	messages := []OutboxMessage{}
+	for _, message := range due {
+		result, err := s.db.Exec(s.rebind(`UPDATE outbox SET next_attempt_at = ? WHERE id = ? AND delivered_at IS NULL AND next_attempt_at <= ?`),
+			now.Add(lease), message.ID.Hex(), now)
+		if err != nil {
+			return messages, err
+		}
+		if claimed, err := result.RowsAffected(); err == nil && claimed == 1 {
+			message.NextAttemptAt = now.Add(lease)
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+// MarkOutboxMessageDelivered records the delivery of a message in the database
+func (s *SQLOrderStore) MarkOutboxMessageDelivered(message OutboxMessage) error {
+	_, err := s.db.Exec(s.rebind(`UPDATE outbox SET delivered_at = ? WHERE id = ?`), time.Now().UTC(), message.ID.Hex())
+	return err
+}
+
+// RetryOutboxMessage records a failed attempt to send a message in the database
+func (s *SQLOrderStore) RetryOutboxMessage(message OutboxMessage, nextAttemptAt time.Time, lastError string) error {
+	_, err := s.db.Exec(s.rebind(`UPDATE outbox SET attempts = attempts + 1, next_attempt_at = ?, last_error = ? WHERE id = ?`),
+		nextAttemptAt, lastError, message.ID.Hex())
+	return err
+}
+
+// ExpiredOrders returns a page of orders in the database past their retention, see OrderArchiver
+func (s *SQLOrderStore) ExpiredOrders(cutoff time.Time, afterID primitive.ObjectID, limit int) ([]Order, error) {
+	statuses := terminalStatuses()
+	args := []interface{}{afterID.Hex(), cutoff.UTC()}
+	for _, status := range statuses {
+		args = append(args, status)
+	}
+
+	query := `SELECT ` + orderColumns + ` FROM orders WHERE id > ? AND created_at < ? AND status IN (?` +
+		strings.Repeat(", ?", len(statuses)-1) + `) ORDER BY id LIMIT ` + strconv.Itoa(limit)
+	orders, err := s.queryOrders(query, args...)
+	if err != nil {
+		printErr("Problem finding expired orders: ", err)
+	}
+	return orders, err
+}
+
+// DeleteOrders removes archived orders and their SKUs from the database in a single transaction
+func (s *SQLOrderStore) DeleteOrders(ids []primitive.ObjectID) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		if _, err = tx.Exec(s.rebind(`DELETE FROM order_skus WHERE order_id = ?`), id.Hex()); err != nil {
+			break
+		}
+		var result sql.Result
+		if result, err = tx.Exec(s.rebind(`DELETE FROM orders WHERE id = ?`), id.Hex()); err != nil {
+			break
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			deleted++
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		printErr("Problem deleting archived orders: ", err)
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// queryOrders runs a query selecting orderColumns
+func (s *SQLOrderStore) queryOrders(query string, args ...interface{}) ([]Order, error) {
+	rows, err := s.db.Query(s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+// rebind turns the ? placeholders of a query into the $1, $2... placeholders PostgreSQL expects.
+// The queries don't contain question marks other than placeholders.
+func (s *SQLOrderStore) rebind(query string) string {
+	if s.dialect != "postgres" || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// rowScanner is either a *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanOrder reads a row of orderColumns into an order
+func scanOrder(row rowScanner) (Order, error) {
+	var order Order
+	var id, items, history string
+	var cancellation sql.NullString
+
+	err := row.Scan(&id, &order.EmailAddress, &order.EmailAddressNormalized, &order.Product, &items,
+		&order.Subtotal, &order.Total, &order.Status, &order.CreatedAt, &history, &cancellation, &order.Version)
+	if err != nil {
+		return order, err
+	}
+
+	if order.ID, err = primitive.ObjectIDFromHex(strings.TrimSpace(id)); err != nil {
+		return order, err
+	}
+	order.CreatedAt = order.CreatedAt.UTC()
+	if err = json.Unmarshal([]byte(items), &order.Items); err != nil {
+		return order, err
+	}
+	if err = json.Unmarshal([]byte(history), &order.StatusHistory); err != nil {
+		return order, err
+	}
+	if cancellation.Valid {
+		order.Cancellation = &Cancellation{}
+		if err = json.Unmarshal([]byte(cancellation.String), order.Cancellation); err != nil {
+			return order, err
+		}
+	}
+	return order, nil
+}
+
+// marshalOrderColumns encodes the parts of an order stored as JSON
+func marshalOrderColumns(order Order) (items string, history string, cancellation sql.NullString, err error) {
+	b, err := json.Marshal(order.Items)
+	if err != nil {
+		return
+	}
+	items = string(b)
+
+	if b, err = json.Marshal(order.StatusHistory); err != nil {
+		return
+	}
+	history = string(b)
+
+	if order.Cancellation != nil {
+		if b, err = json.Marshal(order.Cancellation); err != nil {
+			return
+		}
+		cancellation = sql.NullString{String: string(b), Valid: true}
+	}
+	return
+}
@@ -0,0 +1,174 @@
+//go:build cgo
+// +build cgo
+
+package models
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newTestSQLOrderStore(t *testing.T) *SQLOrderStore {
+	dataSourceName := filepath.Join(t.TempDir(), "orders.db")
+	store, err := NewSQLOrderStore("sqlite3", dataSourceName)
+	if err != nil {
+		t.Fatalf("NewSQLOrderStore returned %v", err)
+	}
+
+	// Opening a migrated database again must not re-apply the migrations
+	again, err := NewSQLOrderStore("sqlite3", dataSourceName)
+	if err != nil {
+		t.Fatalf("NewSQLOrderStore of a migrated database returned %v", err)
+	}
+	again.db.Close()
+
+	return store
+}
+
+func TestSQLOrderStoreOrders(t *testing.T) {
+	store := newTestSQLOrderStore(t)
+
+	legacy, err := store.Create(Order{EmailAddress: "jane@example.com", Product: "sku-odd", Total: 3})
+	if err != nil {
+		t.Fatalf("Create returned %v", err)
+	}
+	orders, errs := store.CreateMany([]Order{newTestOrder("Jane@example.com", "sku-even"), newTestOrder("john@example.com", "sku-odd")})
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatalf("CreateMany returned %v", errs)
+	}
+
+	order, err := store.Get(legacy.ID.Hex())
+	if err != nil {
+		t.Fatalf("Get returned %v", err)
+	}
+	if order.ID != legacy.ID || order.Status != StatusOpen || len(order.Items) != 1 || !order.CreatedAt.Equal(legacy.CreatedAt) {
+		t.Errorf("Get returned %+v, expected %+v", order, legacy)
+	}
+	if _, err := store.Get("5b9f2c3e8d1a4f0001a1b2c3"); err != ErrOrderNotFound {
+		t.Errorf("Get of an unknown ID returned %v", err)
+	}
+
+	if count, _ := store.Count(); count != 3 {
+		t.Errorf("Count returned %d, expected 3", count)
+	}
+
+	page, err := store.List(OrderFilter{Product: "sku-odd", Limit: 1})
+	if err != nil || len(page.Orders) != 1 || page.Orders[0].ID != legacy.ID || page.NextCursor == "" {
+		t.Fatalf("List returned %+v, %v", page, err)
+	}
+	page, _ = store.List(OrderFilter{Product: "sku-odd", Cursor: page.NextCursor})
+	if len(page.Orders) != 1 || page.Orders[0].ID != orders[1].ID || page.NextCursor != "" {
+		t.Errorf("The second page was %+v", page)
+	}
+
+	if _, err := CancelOrder(store, legacy.ID.Hex(), AnyVersion, "duplicate", "jane", "correlation-1"); err != nil {
+		t.Fatalf("CancelOrder returned %v", err)
+	}
+	order, _ = store.Get(legacy.ID.Hex())
+	if order.Status != StatusCancelled || len(order.StatusHistory) != 2 || order.Cancellation == nil {
+		t.Errorf("The cancelled order is %+v", order)
+	}
+	if order.Version != 2 {
+		t.Errorf("The cancelled order is at version %d, expected 2", order.Version)
+	}
+	stale := StatusTransition{From: StatusOpen, To: StatusConfirmed}
+	if _, err := store.UpdateStatus(legacy, stale, nil); err != ErrVersionConflict {
+		t.Errorf("UpdateStatus at a stale version returned %v", err)
+	}
+
+	history, err := GetCustomerOrderHistory(store, "jane@example.com", 10)
+	if err != nil || history.OrderCount != 2 || history.LifetimeValue != 2.5 || history.Orders[0].ID != orders[0].ID {
+		t.Errorf("GetCustomerOrderHistory returned %+v, %v", history, err)
+	}
+
+	// Every order was stored with its outbox message, and the cancellation with its own
+	messages, err := store.ClaimOutboxMessages(10, time.Minute)
+	if err != nil || len(messages) != 4 || messages[0].OrderID != legacy.ID.Hex() {
+		t.Fatalf("ClaimOutboxMessages returned %+v, %v", messages, err)
+	}
+	if event := decodeOutboxEvent(messages[3]); event.Type != OrderCancelledEventType || event.Subject != legacy.ID.Hex() || event.CorrelationID != "correlation-1" {
+		t.Errorf("The cancellation was stored with the event %+v", event)
+	}
+	if again, _ := store.ClaimOutboxMessages(10, time.Minute); len(again) != 0 {
+		t.Errorf("Claimed messages were claimed again: %+v", again)
+	}
+	store.MarkOutboxMessageDelivered(messages[0])
+	store.RetryOutboxMessage(messages[1], time.Now().UTC(), "not acknowledged")
+	messages, _ = store.ClaimOutboxMessages(10, time.Minute)
+	if len(messages) != 1 || messages[0].Attempts != 1 || messages[0].OrderID != orders[0].ID.Hex() {
+		t.Errorf("After a retry ClaimOutboxMessages returned %+v", messages)
+	}
+}
+
+func TestSQLOrderStoreIdempotency(t *testing.T) {
+	store := newTestSQLOrderStore(t)
+
+	existing, reservation, err := store.BeginIdempotentRequest("key", "hash")
+	if existing != nil || reservation == "" || err != nil {
+		t.Fatalf("First BeginIdempotentRequest returned %v, %q, %v", existing, reservation, err)
+	}
+	if err := store.CompleteIdempotentRequest("key", reservation, "order", 200, []byte("{}")); err != nil {
+		t.Errorf("CompleteIdempotentRequest returned %v", err)
+	}
+	existing, _, err = store.BeginIdempotentRequest("key", "hash")
+	if err != nil || existing == nil || existing.StatusCode != 200 || string(existing.Response) != "{}" {
+		t.Errorf("BeginIdempotentRequest of a completed key returned %v, %v", existing, err)
+	}
+
+	_, reservation, _ = store.BeginIdempotentRequest("failed", "hash")
+	store.ReleaseIdempotentRequest("failed", reservation)
+	if existing, _, _ := store.BeginIdempotentRequest("failed", "hash"); existing != nil {
+		t.Errorf("A released key was remembered: %v", existing)
+	}
+
+	// A reservation whose request never completed is given to a single one of the requests racing for it
+	_, reservation, _ = store.BeginIdempotentRequest("abandoned", "hash")
+	store.db.Exec(store.rebind(`UPDATE idempotency_keys SET created_at = ? WHERE idempotency_key = ?`), time.Now().UTC().Add(-time.Hour), "abandoned")
+	if reserved := raceIdempotentRequests(store, "abandoned"); reserved != 1 {
+		t.Errorf("%d requests reserved the abandoned key, expected 1", reserved)
+	}
+	// and the slow original request can no longer complete or release it
+	if err := store.CompleteIdempotentRequest("abandoned", reservation, "order", 200, []byte("{}")); err != ErrIdempotencyReservationLost {
+		t.Errorf("CompleteIdempotentRequest of a key taken over returned %v, expected %v", err, ErrIdempotencyReservationLost)
+	}
+	if err := store.ReleaseIdempotentRequest("abandoned", reservation); err != ErrIdempotencyReservationLost {
+		t.Errorf("ReleaseIdempotentRequest of a key taken over returned %v, expected %v", err, ErrIdempotencyReservationLost)
+	}
+	if existing, _, _ := store.BeginIdempotentRequest("abandoned", "hash"); existing == nil || !existing.Pending() {
+		t.Errorf("The new reservation of the key was overwritten: %v", existing)
+	}
+}
+
+func TestSQLOrderStoreRetention(t *testing.T) {
+	store := newTestSQLOrderStore(t)
+
+	cancelled, _ := store.Create(newTestOrder("jane@example.com", "sku-1"))
+	open, _ := store.Create(newTestOrder("jane@example.com", "sku-1"))
+	if _, err := CancelOrder(store, cancelled.ID.Hex(), AnyVersion, "changed my mind", "jane", ""); err != nil {
+		t.Fatalf("CancelOrder returned %v", err)
+	}
+
+	if orders, err := store.ExpiredOrders(time.Now().UTC().Add(-time.Hour), primitive.NilObjectID, 10); err != nil || len(orders) != 0 {
+		t.Errorf("ExpiredOrders with a cutoff before the orders returned %+v, %v", orders, err)
+	}
+	orders, err := store.ExpiredOrders(time.Now().UTC().Add(time.Hour), primitive.NilObjectID, 10)
+	if err != nil || len(orders) != 1 || orders[0].ID != cancelled.ID {
+		t.Fatalf("ExpiredOrders returned %+v, %v, expected the cancelled order", orders, err)
+	}
+	if orders, _ := store.ExpiredOrders(time.Now().UTC().Add(time.Hour), cancelled.ID, 10); len(orders) != 0 {
+		t.Errorf("ExpiredOrders after the last page returned %+v", orders)
+	}
+
+	if deleted, err := store.DeleteOrders([]primitive.ObjectID{cancelled.ID}); err != nil || deleted != 1 {
+		t.Errorf("DeleteOrders returned %d, %v", deleted, err)
+	}
+	if _, err := store.Get(cancelled.ID.Hex()); err != ErrOrderNotFound {
+		t.Errorf("Get of a deleted order returned %v", err)
+	}
+	if _, err := store.Get(open.ID.Hex()); err != nil {
+		t.Errorf("Get of the open order returned %v", err)
+	}
+}
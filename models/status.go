@@ -0,0 +1,208 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Order statuses. An order starts Open and moves forward through
+// Confirmed and Fulfilled to Closed. It can be Cancelled before it is
+// fulfilled and marked Failed at any point before it is closed.
+const (
+	StatusOpen      = "Open"
+	StatusConfirmed = "Confirmed"
+	StatusFulfilled = "Fulfilled"
+	StatusClosed    = "Closed"
+	StatusCancelled = "Cancelled"
+	StatusFailed    = "Failed"
+)
+
+// orderTransitions lists the statuses an order may move to from each status.
+// Statuses without any onward transitions are terminal.
+var orderTransitions = map[string][]string{
+	StatusOpen:      {StatusConfirmed, StatusCancelled, StatusFailed},
+	StatusConfirmed: {StatusFulfilled, StatusCancelled, StatusFailed},
+	StatusFulfilled: {StatusClosed, StatusFailed},
+	StatusClosed:    nil,
+	StatusCancelled: nil,
+	StatusFailed:    nil,
+}
+
+// ErrInvalidStatus is returned when asked to move an order to an unknown status
+var ErrInvalidStatus = errors.New("status is not a valid order status")
+
+// ErrCancelWithCancelOrder is returned when asked to move an order to Cancelled with TransitionOrderStatus.
+// A cancellation records why and by whom and tells fulfillment, so it goes through CancelOrder.
+var ErrCancelWithCancelOrder = errors.New("orders are cancelled with CancelOrder, not by changing their status")
+
+// ErrVersionConflict is returned by OrderStore.UpdateStatus when the order changed since it was read
+var ErrVersionConflict = errors.New("order changed since it was read")
+
+// AnyVersion lets TransitionOrderStatus and CancelOrder update an order whatever its version
+const AnyVersion int64 = -1
+
+// maxUpdateAttempts is how often an update is attempted when other updates keep changing the order first
+const maxUpdateAttempts = 3
+
+// StaleVersionError is returned when an order is updated at a version that is no longer its current version
+type StaleVersionError struct {
+	Expected int64
+	Current  int64
+}
+
+func (e *StaleVersionError) Error() string {
+	return fmt.Sprintf("order is at version %d, not %d", e.Current, e.Expected)
+}
+
+// StatusTransition records a single change of an order's status
+type StatusTransition struct {
+	From   string    `json:"from" bson:"from"`
+	To     string    `json:"to" bson:"to"`
+	At     time.Time `json:"at" bson:"at"`
+	Reason string    `json:"reason,omitempty" bson:"reason,omitempty"`
+	Actor  string    `json:"actor,omitempty" bson:"actor,omitempty"`
+}
+
+// Cancellation records why and by whom an order was cancelled
+type Cancellation struct {
+	Reason string    `json:"reason" bson:"reason"`
+	Actor  string    `json:"actor" bson:"actor"`
+	At     time.Time `json:"at" bson:"at"`
+}
+
+// IsCancellable reports whether an order in the given status can still be cancelled
+func IsCancellable(status string) bool {
+	return CanTransition(status, StatusCancelled)
+}
+
+// TransitionError is returned when an order can't move from its current status to the requested one
+type TransitionError struct {
+	From    string
+	To      string
+	Allowed []string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("order can't move from %s to %s", e.From, e.To)
+}
+
+// IsValidStatus reports whether status is part of the order lifecycle
+func IsValidStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+// IsTerminalStatus reports whether an order in the given status will never change again
+func IsTerminalStatus(status string) bool {
+	transitions, ok := orderTransitions[status]
+	return ok && len(transitions) == 0
+}
+
+// terminalStatuses lists the statuses orders never leave
+func terminalStatuses() []string {
+	var statuses []string
+	for status := range orderTransitions {
+		if IsTerminalStatus(status) {
+			statuses = append(statuses, status)
+		}
+	}
+	sort.Strings(statuses)
+	return statuses
+}
+
+// AllowedTransitions returns the statuses an order in the given status may move to
+func AllowedTransitions(status string) []string {
+	return append([]string{}, orderTransitions[status]...)
+}
+
+// CanTransition reports whether an order may move from one status to another
+func CanTransition(from string, to string) bool {
+	for _, allowed := range orderTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionOrderStatus moves an order to a new status and records the
+// transition in the order's status history. Illegal transitions return a *TransitionError, and
+// cancellations ErrCancelWithCancelOrder. Unless version is AnyVersion, the order is only updated
+// at that version and a *StaleVersionError is returned when it is at another one.
+func TransitionOrderStatus(store OrderStore, orderID string, version int64, status string, reason string, actor string) (Order, error) {
+	if !IsValidStatus(status) {
+		return Order{}, ErrInvalidStatus
+	}
+	if status == StatusCancelled {
+		return Order{}, ErrCancelWithCancelOrder
+	}
+	return transitionOrderStatus(store, orderID, version, StatusTransition{To: status, Reason: reason, Actor: actor}, false, "")
+}
+
+// CancelOrder cancels an order that is still in a cancellable status, recording why and by whom.
+// Fulfillment is told through the outbox, with the correlation ID of the request cancelling it.
+// The version is checked as by TransitionOrderStatus.
+func CancelOrder(store OrderStore, orderID string, version int64, reason string, actor string, correlationID string) (Order, error) {
+	var errs []FieldError
+	if strings.TrimSpace(reason) == "" {
+		errs = append(errs, FieldError{"reason", FieldErrorRequired, "is required"})
+	}
+	if strings.TrimSpace(actor) == "" {
+		errs = append(errs, FieldError{"actor", FieldErrorRequired, "is required"})
+	}
+	if len(errs) > 0 {
+		return Order{}, &ValidationError{errs}
+	}
+
+	transition := StatusTransition{To: StatusCancelled, Reason: reason, Actor: actor}
+	return transitionOrderStatus(store, orderID, version, transition, true, correlationID)
+}
+
+// transitionOrderStatus applies transition to an order if its current status allows it,
+// recording a cancellation along with it if asked to. When another update changes the order
+// first, the transition is checked again against the changed order, unless a version was given.
+func transitionOrderStatus(store OrderStore, orderID string, version int64, transition StatusTransition, cancel bool, correlationID string) (Order, error) {
+	for attempt := 1; ; attempt++ {
+		order, err := store.Get(orderID)
+		if err != nil {
+			return order, err
+		}
+		order.CorrelationID = correlationID
+		if version != AnyVersion && order.Version != version {
+			return order, &StaleVersionError{Expected: version, Current: order.Version}
+		}
+		if !CanTransition(order.Status, transition.To) {
+			return order, &TransitionError{From: order.Status, To: transition.To, Allowed: AllowedTransitions(order.Status)}
+		}
+
+		transition.From = order.Status
+		transition.At = time.Now().UTC()
+
+		var cancellation *Cancellation
+		if cancel {
+			cancellation = &Cancellation{Reason: transition.Reason, Actor: transition.Actor, At: transition.At}
+		}
+
+		updated, err := store.UpdateStatus(order, transition, cancellation)
+		if err != ErrVersionConflict || attempt == maxUpdateAttempts {
+			return updated, err
+		}
+	}
+}
+
+// applyStatusTransition returns a copy of order moved by transition at the next version,
+// with the cancellation if not nil. It is the order as UpdateStatus stores it.
+func applyStatusTransition(order Order, transition StatusTransition, cancellation *Cancellation) Order {
+	order = cloneOrder(order)
+	order.Version++
+	order.Status = transition.To
+	order.StatusHistory = append(order.StatusHistory, transition)
+	if cancellation != nil {
+		c := *cancellation
+		order.Cancellation = &c
+	}
+	return order
+}
@@ -0,0 +1,102 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// OrderStore persists orders. The order controller only talks to the database through it,
+// so the backing store can be swapped without touching the API.
+type OrderStore interface {
+	// Create stores a new order and returns it with its ID, status and history set
+	Create(order Order) (Order, error)
+
+	// CreateMany stores a batch of new orders. It returns every order as stored and,
+	// at the same index, the error for each order that couldn't be stored, or ErrOrderOutcomeUnknown
+	// when the store can't tell whether the order was stored.
+	CreateMany(orders []Order) ([]Order, []error)
+
+	// Get returns the order with the given ID, or ErrInvalidOrderID / ErrOrderNotFound
+	Get(orderID string) (Order, error)
+
+	// List returns a page of orders matching the filter
+	List(filter OrderFilter) (OrderPage, error)
+
+	// Count returns the number of stored orders
+	Count() (int, error)
+
+	// UpdateStatus applies transition to an order as read and records it in the status history,
+	// and increments the order's version. A cancellation, if not nil, is recorded along with the
+	// message telling fulfillment about it, which the outbox relay sends. It returns ErrVersionConflict
+	// if the order is no longer at the version it was read at. Use TransitionOrderStatus or
+	// CancelOrder, which check the transition is allowed first.
+	UpdateStatus(order Order, transition StatusTransition, cancellation *Cancellation) (Order, error)
+
+	// CustomerOrders returns the order history of the customer with the normalized email address,
+	// with at most limit orders. Use GetCustomerOrderHistory, which validates and normalizes the address.
+	CustomerOrders(normalizedEmailAddress string, limit int) (CustomerOrderHistory, error)
+}
+
+// IdempotencyStore remembers requests sent with an Idempotency-Key
+type IdempotencyStore interface {
+	// BeginIdempotentRequest reserves key for a request with the given hash.
+	// If the key was already used within the idempotency window the existing record is returned
+	// and the caller must not process the request again. Otherwise it returns nil and a reservation,
+	// and the caller must finish with CompleteIdempotentRequest or ReleaseIdempotentRequest.
+	BeginIdempotentRequest(key string, requestHash string) (*IdempotencyRecord, string, error)
+
+	// CompleteIdempotentRequest stores the response of a request reserved with BeginIdempotentRequest.
+	// It returns ErrIdempotencyReservationLost if another request took the key over in the meantime.
+	CompleteIdempotentRequest(key string, reservation string, orderID string, statusCode int, response []byte) error
+
+	// ReleaseIdempotentRequest forgets a key reserved with BeginIdempotentRequest
+	// so that a request which failed can be retried with the same key.
+	// It returns ErrIdempotencyReservationLost if another request took the key over in the meantime.
+	ReleaseIdempotentRequest(key string, reservation string) error
+}
+
+// NewOrderStore returns the store picked by the ORDERSTORE environment variable: "mongo", the default,
+// for MongoDB/CosmosDB, "postgres" or "sqlite" for a SQL database at SQLDSN, or "memory" for an
+// in-memory store that forgets every order on restart. Every store also holds the outbox of its orders.
+func NewOrderStore() (OrderStore, IdempotencyStore, Outbox, error) {
+	switch orderStoreBackend {
+	case "", "mongo":
+		log.Println("Using the MongoDB order store")
+		store, err := NewMongoOrderStore()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return store, store, store, nil
+	case "postgres", "sqlite":
+		driverName := orderStoreBackend
+		if driverName == "sqlite" {
+			driverName = "sqlite3"
+		}
+		if !isSQLDriverRegistered(driverName) {
+			return nil, nil, nil, fmt.Errorf("ORDERSTORE %s isn't available in this build, sqlite needs CGO_ENABLED=1", orderStoreBackend)
+		}
+		log.Printf("Using the %s order store", orderStoreBackend)
+		store, err := NewSQLOrderStore(driverName, sqlDataSourceName)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return store, store, store, nil
+	case "memory":
+		log.Println("Using the in-memory order store. Orders are lost when the service stops.")
+		store := NewMemoryOrderStore()
+		return store, store, store, nil
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown ORDERSTORE %q, use mongo, postgres, sqlite or memory", orderStoreBackend)
+	}
+}
+
+// isSQLDriverRegistered reports whether a database/sql driver is compiled in
+func isSQLDriverRegistered(driverName string) bool {
+	for _, name := range sql.Drivers() {
+		if name == driverName {
+			return true
+		}
+	}
+	return false
+}
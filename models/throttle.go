@@ -0,0 +1,169 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// cosmosThrottledCode is the error code CosmosDB returns when a request exceeds the provisioned RUs (HTTP 429)
+const cosmosThrottledCode = 16500
+
+// Backoff between retries of a throttled operation, used when CosmosDB doesn't send a longer RetryAfterMs
+const (
+	throttleBaseDelay = 100 * time.Millisecond
+	throttleMaxDelay  = 5 * time.Second
+)
+
+// How often a throttled operation is retried. Override with the COSMOS_THROTTLE_RETRIES environment variable.
+var maxThrottleRetries = 5
+
+// retryAfterPattern finds the retry hint CosmosDB puts in the message of throttling errors
+var retryAfterPattern = regexp.MustCompile(`RetryAfterMs=(\d+)`)
+
+// ThrottledError is returned when CosmosDB kept throttling an operation after every retry.
+// The request may be sent again after RetryAfter.
+type ThrottledError struct {
+	Operation  string
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%s was throttled by the database: %v", e.Operation, e.Err)
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return e.Err
+}
+
+// ThrottleCounts counts the throttling of one kind of operation
+type ThrottleCounts struct {
+	Throttled int64 `json:"throttled"` // throttled responses, including those of retries
+	Recovered int64 `json:"recovered"` // operations that succeeded after being throttled
+	Failed    int64 `json:"failed"`    // operations that were still throttled after every retry
+}
+
+var throttleMetrics = struct {
+	sync.Mutex
+	operations map[string]*ThrottleCounts
+}{operations: map[string]*ThrottleCounts{}}
+
+// ThrottleMetrics returns the throttling counts of every operation since the service started
+func ThrottleMetrics() map[string]ThrottleCounts {
+	throttleMetrics.Lock()
+	defer throttleMetrics.Unlock()
+
+	snapshot := make(map[string]ThrottleCounts, len(throttleMetrics.operations))
+	for operation, counts := range throttleMetrics.operations {
+		snapshot[operation] = *counts
+	}
+	return snapshot
+}
+
+// countThrottle updates the counts of an operation under the metrics lock
+func countThrottle(operation string, update func(counts *ThrottleCounts)) {
+	throttleMetrics.Lock()
+	defer throttleMetrics.Unlock()
+
+	counts, ok := throttleMetrics.operations[operation]
+	if !ok {
+		counts = &ThrottleCounts{}
+		throttleMetrics.operations[operation] = counts
+	}
+	update(counts)
+}
+
+// throttleRetryAfter reports whether err is a CosmosDB throttling error, along with
+// the retry hint it carries or zero if it has none.
+func throttleRetryAfter(err error) (time.Duration, bool) {
+	if err == nil {
+		return 0, false
+	}
+
+	var serverErr mongo.ServerError
+	throttled := errors.As(err, &serverErr) && serverErr.HasErrorCode(cosmosThrottledCode)
+	if !throttled && !strings.Contains(err.Error(), "Request rate is large") {
+		return 0, false
+	}
+
+	if match := retryAfterPattern.FindStringSubmatch(err.Error()); match != nil {
+		if ms, convErr := strconv.Atoi(match[1]); convErr == nil {
+			return time.Duration(ms) * time.Millisecond, true
+		}
+	}
+	return 0, true
+}
+
+// throttleDelay is how long to wait before retry number attempt, at least the hint sent by CosmosDB.
+// The jitter spreads out the retries of requests that were throttled together.
+func throttleDelay(attempt int, retryAfter time.Duration) time.Duration {
+	delay := throttleBaseDelay << uint(attempt)
+	if delay > throttleMaxDelay || delay <= 0 {
+		delay = throttleMaxDelay
+	}
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// retryThrottled runs a MongoDB operation and retries it while CosmosDB throttles it, up to
+// maxThrottleRetries times or until ctx is done. A throttled request made no changes, so retrying
+// is safe. When it gives up it returns a *ThrottledError, other errors are returned as they are.
+func retryThrottled(ctx context.Context, operation string, fn func() error) error {
+	throttled := false
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		retryAfter, isThrottled := throttleRetryAfter(err)
+		if !isThrottled {
+			if throttled && err == nil {
+				countThrottle(operation, func(c *ThrottleCounts) { c.Recovered++ })
+				log.Printf("%s succeeded after %d throttled attempts", operation, attempt)
+			}
+			return err
+		}
+
+		throttled = true
+		countThrottle(operation, func(c *ThrottleCounts) { c.Throttled++ })
+
+		delay := throttleDelay(attempt, retryAfter)
+		if attempt >= maxThrottleRetries {
+			countThrottle(operation, func(c *ThrottleCounts) { c.Failed++ })
+			printErr(fmt.Sprintf("Giving up on %s, still throttled after %d retries: ", operation, attempt), err)
+			return &ThrottledError{Operation: operation, RetryAfter: delay, Err: err}
+		}
+
+		log.Printf("%s was throttled, retrying in %v", operation, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			countThrottle(operation, func(c *ThrottleCounts) { c.Failed++ })
+			return &ThrottledError{Operation: operation, RetryAfter: delay, Err: err}
+		case <-timer.C:
+		}
+	}
+}
+
+// initThrottleRetries reads how often throttled operations are retried
+func initThrottleRetries() {
+	if retries := os.Getenv("COSMOS_THROTTLE_RETRIES"); retries != "" {
+		if n, err := strconv.Atoi(retries); err == nil && n >= 0 {
+			maxThrottleRetries = n
+		} else {
+			printErr("Ignoring invalid COSMOS_THROTTLE_RETRIES: ", retries)
+		}
+	}
+	log.Printf("Throttled operations are retried up to %d times. You can override by setting the COSMOS_THROTTLE_RETRIES environment variable.", maxThrottleRetries)
+}
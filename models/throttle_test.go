@@ -0,0 +1,67 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func newThrottledError(message string) error {
+	return mongo.CommandError{Code: cosmosThrottledCode, Message: message}
+}
+
+func TestThrottleRetryAfter(t *testing.T) {
+	retryAfter, throttled := throttleRetryAfter(newThrottledError("Request rate is large. More Request Units may be needed, so no changes were made. Please retry this request later. RetryAfterMs=42"))
+	if !throttled || retryAfter != 42*time.Millisecond {
+		t.Errorf("throttleRetryAfter returned %v, %t", retryAfter, throttled)
+	}
+	if _, throttled := throttleRetryAfter(mongo.CommandError{Code: 11000, Message: "duplicate key"}); throttled {
+		t.Error("A duplicate key error was taken for throttling")
+	}
+	if _, throttled := throttleRetryAfter(nil); throttled {
+		t.Error("No error was taken for throttling")
+	}
+}
+
+func TestRetryThrottled(t *testing.T) {
+	defer func(retries int) { maxThrottleRetries = retries }(maxThrottleRetries)
+	maxThrottleRetries = 2
+
+	calls := 0
+	err := retryThrottled(context.Background(), "test recovers", func() error {
+		calls++
+		if calls == 1 {
+			return newThrottledError("RetryAfterMs=1")
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("retryThrottled returned %v after %d calls, expected success after 2", err, calls)
+	}
+	if counts := ThrottleMetrics()["test recovers"]; counts != (ThrottleCounts{Throttled: 1, Recovered: 1}) {
+		t.Errorf("The recovered operation was counted as %+v", counts)
+	}
+
+	calls = 0
+	err = retryThrottled(context.Background(), "test gives up", func() error {
+		calls++
+		return newThrottledError("RetryAfterMs=1")
+	})
+	var throttledErr *ThrottledError
+	if !errors.As(err, &throttledErr) || calls != 3 || throttledErr.RetryAfter <= 0 {
+		t.Errorf("retryThrottled returned %v after %d calls, expected a ThrottledError after 3", err, calls)
+	}
+	if counts := ThrottleMetrics()["test gives up"]; counts != (ThrottleCounts{Throttled: 3, Failed: 1}) {
+		t.Errorf("The failed operation was counted as %+v", counts)
+	}
+
+	// Other errors aren't retried
+	calls = 0
+	other := errors.New("other")
+	if err := retryThrottled(context.Background(), "test other", func() error { calls++; return other }); err != other || calls != 1 {
+		t.Errorf("retryThrottled returned %v after %d calls for another error", err, calls)
+	}
+}
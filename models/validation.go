@@ -0,0 +1,221 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Field error codes reported in FieldError.Code
+const (
+	FieldErrorRequired  = "required"
+	FieldErrorInvalid   = "invalid"
+	FieldErrorReadOnly  = "readOnly"
+	FieldErrorUnknown   = "unknown"
+	FieldErrorType      = "type"
+	FieldErrorMalformed = "malformed"
+)
+
+// Fields a client may set when submitting an order
+var orderClientFields = []string{"emailAddress", "product", "total", "items"}
+
+// Fields assigned by the server that a client must not set
+var orderServerFields = []string{"id", "status", "createdAt", "statusHistory", "subtotal", "cancellation", "version"}
+
+// Fields a client may set on a line item
+var lineItemClientFields = []string{"sku", "quantity", "unitPrice"}
+
+// Fields of a line item computed by the server
+var lineItemServerFields = []string{"lineTotal"}
+
+// FieldError describes a single field that failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when a submitted order fails validation. It carries every
+// field violation found so clients can fix them all at once.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, len(e.Errors))
+	for i, fieldErr := range e.Errors {
+		fields[i] = fieldErr.Field + ": " + fieldErr.Message
+	}
+	return "order is not valid: " + strings.Join(fields, "; ")
+}
+
+// DecodeOrder strictly decodes an order submitted by a client, validates it and computes its totals.
+// Unknown fields, server assigned fields and malformed JSON are all reported as a *ValidationError.
+func DecodeOrder(body []byte) (Order, error) {
+	var order Order
+
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return order, &ValidationError{[]FieldError{{"body", FieldErrorRequired, "request body is empty"}}}
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		message := "request body must be a JSON object"
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			message = fmt.Sprintf("request body is not valid JSON at offset %d", syntaxErr.Offset)
+		}
+		return order, &ValidationError{[]FieldError{{"body", FieldErrorMalformed, message}}}
+	}
+
+	errs := checkFields("", raw, orderClientFields, orderServerFields)
+
+	// The total of a line item order is computed from its items. An empty items array makes a legacy order.
+	var items []json.RawMessage
+	if rawItems, ok := findField(raw, "items"); ok {
+		json.Unmarshal(rawItems, &items)
+	}
+	hasItems := len(items) > 0
+	if _, hasTotal := findField(raw, "total"); hasItems && hasTotal {
+		errs = append(errs, FieldError{"total", FieldErrorReadOnly, "is computed from items and must not be set"})
+	}
+	if _, hasProduct := findField(raw, "product"); hasItems && hasProduct {
+		errs = append(errs, FieldError{"product", FieldErrorInvalid, "must not be set together with items"})
+	}
+
+	if items, ok := findField(raw, "items"); ok {
+		var rawItems []map[string]json.RawMessage
+		if json.Unmarshal(items, &rawItems) == nil {
+			for i, rawItem := range rawItems {
+				errs = append(errs, checkFields(fmt.Sprintf("items[%d].", i), rawItem, lineItemClientFields, lineItemServerFields)...)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return order, &ValidationError{errs}
+	}
+
+	if err := json.Unmarshal(body, &order); err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			return order, &ValidationError{[]FieldError{{typeErr.Field, FieldErrorType, fmt.Sprintf("must be a JSON %s", jsonTypeName(typeErr.Type))}}}
+		}
+		return order, &ValidationError{[]FieldError{{"body", FieldErrorMalformed, err.Error()}}}
+	}
+
+	if err := ValidateOrder(order); err != nil {
+		return order, err
+	}
+
+	PriceOrder(&order)
+	return order, nil
+}
+
+// checkFields reports unknown and server assigned fields of a JSON object, prefixing field names with prefix
+func checkFields(prefix string, raw map[string]json.RawMessage, clientFields []string, serverFields []string) []FieldError {
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return strings.ToLower(keys[i]) < strings.ToLower(keys[j]) })
+
+	// encoding/json matches field names case-insensitively, so do the same here
+	var errs []FieldError
+	for _, key := range keys {
+		if field, ok := matchField(key, serverFields); ok {
+			errs = append(errs, FieldError{prefix + field, FieldErrorReadOnly, "is assigned by the server and must not be set"})
+		} else if _, ok := matchField(key, clientFields); !ok {
+			errs = append(errs, FieldError{prefix + key, FieldErrorUnknown, "is not a known field"})
+		}
+	}
+	return errs
+}
+
+// findField looks up a field of a JSON object case-insensitively
+func findField(raw map[string]json.RawMessage, field string) (json.RawMessage, bool) {
+	for key, value := range raw {
+		if strings.EqualFold(key, field) {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// ValidateOrder checks the client supplied fields of an order
+func ValidateOrder(order Order) error {
+	var errs []FieldError
+
+	if strings.TrimSpace(order.EmailAddress) == "" {
+		errs = append(errs, FieldError{"emailAddress", FieldErrorRequired, "is required"})
+	} else if !isValidEmailAddress(order.EmailAddress) {
+		errs = append(errs, FieldError{"emailAddress", FieldErrorInvalid, "is not a valid email address"})
+	}
+
+	if len(order.Items) == 0 {
+		// Legacy single product order
+		if strings.TrimSpace(order.Product) == "" {
+			errs = append(errs, FieldError{"product", FieldErrorRequired, "is required when the order has no items"})
+		}
+		if order.Total < 0 {
+			errs = append(errs, FieldError{"total", FieldErrorInvalid, "must not be negative"})
+		}
+	} else if len(order.Items) > MaxLineItems {
+		errs = append(errs, FieldError{"items", FieldErrorInvalid, fmt.Sprintf("must not have more than %d items", MaxLineItems)})
+	}
+
+	for i, item := range order.Items {
+		field := fmt.Sprintf("items[%d].", i)
+		if strings.TrimSpace(item.SKU) == "" {
+			errs = append(errs, FieldError{field + "sku", FieldErrorRequired, "is required"})
+		}
+		if item.Quantity < 1 {
+			errs = append(errs, FieldError{field + "quantity", FieldErrorInvalid, "must be at least 1"})
+		}
+		if item.UnitPrice < 0 {
+			errs = append(errs, FieldError{field + "unitPrice", FieldErrorInvalid, "must not be negative"})
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{errs}
+	}
+	return nil
+}
+
+// isValidEmailAddress accepts a bare RFC 5322 address such as test@domain.com, without a display name
+func isValidEmailAddress(address string) bool {
+	parsed, err := mail.ParseAddress(address)
+	return err == nil && parsed.Name == "" && parsed.Address == address
+}
+
+// matchField returns the canonical name of the field matching key case-insensitively
+func matchField(key string, fields []string) (string, bool) {
+	for _, field := range fields {
+		if strings.EqualFold(key, field) {
+			return field, true
+		}
+	}
+	return "", false
+}
+
+// jsonTypeName returns the name of the JSON type a client should send for a Go type
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "number"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	default:
+		return t.Kind().String()
+	}
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// lineItems returns the JSON of an items array with n valid line items
+func lineItems(n int) string {
+	items := make([]string, n)
+	for i := range items {
+		items[i] = `{"sku": "sku-1", "quantity": 1, "unitPrice": 1}`
+	}
+	return `[` + strings.Join(items, ", ") + `]`
+}
+
+func TestDecodeOrder(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		body     string
+		expected []string // field:code of every field error, none when the order is valid
+	}{
+		{"legacy order", `{"emailAddress": "jane@example.com", "product": "sku-1", "total": 10}`, nil},
+		{"line item order", `{"emailAddress": "jane@example.com", "items": [{"sku": "sku-1", "quantity": 2, "unitPrice": 1.5}]}`, nil},
+		{"field names in another case", `{"EmailAddress": "jane@example.com", "PRODUCT": "sku-1"}`, nil},
+		{"empty body", "  ", []string{"body:required"}},
+		{"malformed JSON", `{"emailAddress": `, []string{"body:malformed"}},
+		{"not an object", `[{"emailAddress": "jane@example.com"}]`, []string{"body:malformed"}},
+		{"unknown fields", `{"emailAddress": "jane@example.com", "product": "sku-1", "colour": "red", "Amount": 1}`, []string{"Amount:unknown", "colour:unknown"}},
+		{"server assigned fields", `{"emailAddress": "jane@example.com", "product": "sku-1", "Status": "Closed", "id": "5b9f2c3e8d1a4f0001a1b2c3"}`, []string{"id:readOnly", "status:readOnly"}},
+		{"version", `{"emailAddress": "jane@example.com", "product": "sku-1", "version": 2}`, []string{"version:readOnly"}},
+		{"total with items", `{"emailAddress": "jane@example.com", "total": 3, "items": [{"sku": "sku-1", "quantity": 1, "unitPrice": 3}]}`, []string{"total:readOnly"}},
+		{"product with items", `{"emailAddress": "jane@example.com", "product": "sku-1", "items": [{"sku": "sku-1", "quantity": 1, "unitPrice": 3}]}`, []string{"product:invalid"}},
+		{"product with empty items", `{"emailAddress": "jane@example.com", "product": "sku-1", "total": 10, "items": []}`, nil},
+		{"line item fields", `{"emailAddress": "jane@example.com", "items": [{"sku": "sku-1", "quantity": 1, "unitPrice": 3, "lineTotal": 3, "discount": 1}]}`, []string{"items[0].discount:unknown", "items[0].lineTotal:readOnly"}},
+		{"wrong type", `{"emailAddress": "jane@example.com", "product": "sku-1", "total": "10"}`, []string{"total:type"}},
+		{"missing email address", `{"product": "sku-1"}`, []string{"emailAddress:required"}},
+		{"email address with a name", `{"emailAddress": "Jane <jane@example.com>", "product": "sku-1"}`, []string{"emailAddress:invalid"}},
+		{"neither product nor items", `{"emailAddress": "jane@example.com", "total": 10}`, []string{"product:required"}},
+		{"negative total", `{"emailAddress": "jane@example.com", "product": "sku-1", "total": -1}`, []string{"total:invalid"}},
+		{"invalid line item", `{"emailAddress": "jane@example.com", "items": [{"sku": " ", "quantity": 0, "unitPrice": -1}]}`, []string{"items[0].sku:required", "items[0].quantity:invalid", "items[0].unitPrice:invalid"}},
+		{"most line items", `{"emailAddress": "jane@example.com", "items": ` + lineItems(MaxLineItems) + `}`, nil},
+		{"too many line items", `{"emailAddress": "jane@example.com", "items": ` + lineItems(MaxLineItems+1) + `}`, []string{"items:invalid"}},
+	} {
+		_, err := DecodeOrder([]byte(test.body))
+		var fields []string
+		if err != nil {
+			validationErr, ok := err.(*ValidationError)
+			if !ok {
+				t.Errorf("DecodeOrder of the %s returned %v, expected a *ValidationError", test.name, err)
+				continue
+			}
+			for _, fieldErr := range validationErr.Errors {
+				fields = append(fields, fieldErr.Field+":"+fieldErr.Code)
+			}
+		}
+		if !reflect.DeepEqual(fields, test.expected) {
+			t.Errorf("DecodeOrder of the %s reported %v, expected %v", test.name, fields, test.expected)
+		}
+	}
+}
+
+func TestDecodeOrderPrices(t *testing.T) {
+	order, err := DecodeOrder([]byte(`{"emailAddress": "jane@example.com", "items": [{"sku": "sku-1", "quantity": 2, "unitPrice": 1.5}, {"sku": "sku-2", "quantity": 1, "unitPrice": 0.25}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Items[0].LineTotal != 3 || order.Items[1].LineTotal != 0.25 || order.Subtotal != 3.25 || order.Total != 3.25 {
+		t.Errorf("DecodeOrder priced the order as %+v", order)
+	}
+}
+
+func TestValidateOrder(t *testing.T) {
+	tooManyItems := make([]LineItem, MaxLineItems+1)
+	for i := range tooManyItems {
+		tooManyItems[i] = LineItem{SKU: "sku-1", Quantity: 1}
+	}
+
+	for _, test := range []struct {
+		name     string
+		order    Order
+		expected []string
+	}{
+		{"legacy order", Order{EmailAddress: "jane@example.com", Product: "sku-1", Total: 10}, nil},
+		{"free legacy order", Order{EmailAddress: "jane@example.com", Product: "sku-1"}, nil},
+		{"line item order", Order{EmailAddress: "jane@example.com", Items: []LineItem{{SKU: "sku-1", Quantity: 1}}}, nil},
+		{"empty order", Order{}, []string{"emailAddress:required", "product:required"}},
+		{"invalid email address", Order{EmailAddress: "jane@", Product: "sku-1"}, []string{"emailAddress:invalid"}},
+		{"invalid line items", Order{EmailAddress: "jane@example.com", Items: []LineItem{{SKU: "sku-1", Quantity: 1}, {Quantity: -1, UnitPrice: 1}}}, []string{"items[1].sku:required", "items[1].quantity:invalid"}},
+		{"too many line items", Order{EmailAddress: "jane@example.com", Items: tooManyItems}, []string{"items:invalid"}},
+	} {
+		var fields []string
+		if err := ValidateOrder(test.order); err != nil {
+			for _, fieldErr := range err.(*ValidationError).Errors {
+				fields = append(fields, fieldErr.Field+":"+fieldErr.Code)
+			}
+		}
+		if !reflect.DeepEqual(fields, test.expected) {
+			t.Errorf("ValidateOrder of the %s reported %v, expected %v", test.name, fields, test.expected)
+		}
+	}
+}
@@ -9,28 +9,63 @@ package routers
 
 import (
 	"captureorderfd/controllers"
+	"captureorderfd/models"
+	"log"
 
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/context"
 	"github.com/astaxie/beego/plugins/cors"
 )
 
-func init() {
+// RouteOrders connects to the order store and routes the order API to it.
+// It isn't done in init so that "captureorderfd migrate" doesn't start the API.
+func RouteOrders() {
+	// The order store is shared by every request
+	store, idempotency, outbox, err := models.NewOrderStore()
+	if err != nil {
+		log.Fatal("Can't start without the order store: ", err)
+	}
+
+	// New orders and cancellations are announced from the outbox written along with them
+	publisher, err := models.NewOrderPublisher()
+	if err != nil {
+		log.Fatal("Can't start without the order publisher: ", err)
+	}
+	models.NewOutboxRelay(outbox, publisher).Start()
+
+	// Expired orders are archived in the background when RETENTION_INTERVAL is set on the RETENTION_WORKER instance
+	models.StartRetention(store)
+
 	ns := beego.NewNamespace("/v1",
 		beego.NSNamespace("/order",
 			beego.NSInclude(
-				&controllers.OrderController{},
+				&controllers.OrderController{Store: store, Idempotency: idempotency},
 			),
 		),
 	)
 	beego.AddNamespace(ns)
+}
+
+func init() {
 	beego.Get("/healthz", func(ctx *context.Context) {
 		ctx.Output.Body([]byte("i'm alive!"))
 	})
+	// Counts of the database operations CosmosDB throttled, by operation
+	beego.Get("/metrics/throttling", func(ctx *context.Context) {
+		ctx.Output.JSON(models.ThrottleMetrics(), false, false)
+	})
+	// Progress of the current or last retention run, null if none ran yet
+	beego.Get("/metrics/retention", func(ctx *context.Context) {
+		ctx.Output.JSON(models.LastRetentionReport(), false, false)
+	})
+	// Messages waiting in the spool for the broker, null if SPOOL_DIR isn't set
+	beego.Get("/metrics/spool", func(ctx *context.Context) {
+		ctx.Output.JSON(models.SpoolMetrics(), false, false)
+	})
 	beego.InsertFilter("*", beego.BeforeRouter, cors.Allow(&cors.Options{
 		AllowAllOrigins: true,
 		AllowMethods:    []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:    []string{"Origin", "Authorization", "Access-Control-Allow-Origin"},
-		ExposeHeaders:   []string{"Content-Length", "Access-Control-Allow-Origin"},
+		AllowHeaders:    []string{"Origin", "Authorization", "Access-Control-Allow-Origin", "Content-Type", "Idempotency-Key", "X-Correlation-ID", "If-Match"},
+		ExposeHeaders:   []string{"Content-Length", "Access-Control-Allow-Origin", "Idempotent-Replayed", "X-Correlation-ID", "Retry-After", "ETag"},
 	}))
 }